@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// most ops one StartTimers/StopTimers call of an asyncQueue gets
+const asyncBatch = 1000
+
+// asyncOp is a queued StartTimerAsync (start set) or StopTimerAsync
+type asyncOp struct {
+	ctx    context.Context
+	start  *timerRequest
+	stop   string
+	ack    func(error)
+	queued time.Time
+}
+
+// asyncQueue runs the async calls of a timert through its batch calls, so
+// each round is one transaction or pipeline. The calls only add to pending,
+// the ops queued up while a round runs make the next one, runs of starts and
+// stops are done in order.
+type asyncQueue struct {
+	t       timert
+	lock    sync.Mutex
+	pending []asyncOp
+	closed  bool
+	wake    chan struct{} // has a value when there's something pending
+	quit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newAsyncQueue(t timert) *asyncQueue {
+	q := &asyncQueue{
+		t:    t,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *asyncQueue) start(ctx context.Context, r timerRequest) ackFuture {
+	return q.queue(asyncOp{ctx: ctx, start: &r})
+}
+
+func (q *asyncQueue) stop(ctx context.Context, receiptHandle string) ackFuture {
+	return q.queue(asyncOp{ctx: ctx, stop: receiptHandle})
+}
+
+func (q *asyncQueue) queue(op asyncOp) ackFuture {
+	ack, done := newAck()
+	op.ack = done
+	op.queued = time.Now()
+	if err := op.ctx.Err(); err != nil {
+		done(err)
+		return ack
+	}
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		done(ErrClosed)
+		return ack
+	}
+	q.pending = append(q.pending, op)
+	q.lock.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return ack
+}
+
+// next takes up to asyncBatch pending ops
+func (q *asyncQueue) next() []asyncOp {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	n := len(q.pending)
+	if n > asyncBatch {
+		n = asyncBatch
+	}
+	round := q.pending[:n:n]
+	q.pending = q.pending[n:]
+	if len(q.pending) == 0 {
+		q.pending = nil
+	}
+	return round
+}
+
+func (q *asyncQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.wake:
+		case <-q.quit:
+			return
+		}
+		for {
+			select {
+			case <-q.quit:
+				return
+			default:
+			}
+			round := q.next()
+			if len(round) == 0 {
+				break
+			}
+			for len(round) > 0 {
+				n := 1
+				for n < len(round) && (round[n].start == nil) == (round[0].start == nil) {
+					n++
+				}
+				q.runOps(round[:n])
+				round = round[n:]
+			}
+		}
+	}
+}
+
+// runOps does a run of starts or stops in one call, ops whose ctx is done
+// by now are left out
+func (q *asyncQueue) runOps(ops []asyncOp) {
+	live := ops[:0:0]
+	for _, op := range ops {
+		if err := op.ctx.Err(); err != nil {
+			op.ack(err)
+			continue
+		}
+		live = append(live, op)
+	}
+	if len(live) == 0 {
+		return
+	}
+	var errs []error
+	if live[0].start != nil {
+		reqs := make([]timerRequest, len(live))
+		for i, op := range live {
+			// the deadline counts from the async call, not from this round
+			reqs[i] = *op.start
+			if reqs[i].Timeout >= 0 {
+				if reqs[i].Timeout -= time.Since(op.queued); reqs[i].Timeout < 0 {
+					reqs[i].Timeout = 0
+				}
+			}
+		}
+		errs = q.t.StartTimers(context.Background(), reqs)
+	} else {
+		handles := make([]string, len(live))
+		for i, op := range live {
+			handles[i] = op.stop
+		}
+		errs = q.t.StopTimers(context.Background(), handles)
+	}
+	for i, op := range live {
+		op.ack(errs[i])
+	}
+}
+
+// close fails whatever is queued after it with ErrClosed, it waits for the
+// round in progress. The ops still pending fail with ErrClosed too.
+func (q *asyncQueue) close() {
+	q.once.Do(func() {
+		q.lock.Lock()
+		q.closed = true
+		q.lock.Unlock()
+		close(q.quit)
+	})
+	<-q.done
+	q.lock.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.lock.Unlock()
+	for _, op := range pending {
+		op.ack(ErrClosed)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+)
+
+// catchUpPolicy is what the persistent implementations do with the timers
+// which became overdue while the process was down. It's applied once when
+// TickProcess starts, to the timers due before InitTimer was called.
+type catchUpPolicy int
+
+const (
+	CatchUpFire   catchUpPolicy = iota // fire them all right away, the default
+	CatchUpSpread                      // fire them spread over a window
+	CatchUpDrop                        // drop them without firing
+)
+
+type catchUpConfig struct {
+	Policy catchUpPolicy
+	// Window CatchUpSpread spreads the overdue timers over in deadline
+	// order, one minute by default
+	Window time.Duration
+	// Rate caps CatchUpSpread at this many timers per second, the window
+	// grows to fit them. 0 is no limit.
+	Rate int
+	// Dropped is called for each timer dropped by CatchUpDrop, they are
+	// counted in timerStats.Dropped either way
+	Dropped ExpiryHandler
+}
+
+// deadlines returns the new deadline of each of n overdue timers for
+// CatchUpSpread, in Unix milliseconds
+func (c catchUpConfig) deadlines(n int, now time.Time) []int64 {
+	window := c.Window
+	if window <= 0 {
+		window = time.Minute
+	}
+	if c.Rate > 0 {
+		if need := time.Duration(n) * time.Second / time.Duration(c.Rate); need > window {
+			window = need
+		}
+	}
+	ds := make([]int64, n)
+	for i := range ds {
+		ds[i] = toMillis(now.Add(window * time.Duration(i) / time.Duration(n)))
+	}
+	return ds
+}
+
+func (c catchUpConfig) dropped(receiptHandle string, metadata msgMeta) {
+	if c.Dropped != nil {
+		c.Dropped.TimerExpired(receiptHandle, metadata)
+	}
+}
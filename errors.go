@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errors returned by every timert implementation, check them with errors.Is
+var (
+	// ErrNotFound is returned for a receiptHandle without running timer
+	ErrNotFound = errors.New("timer not found")
+	// ErrAlreadyExpired is returned when the timer has expired already
+	ErrAlreadyExpired = errors.New("timer already expired")
+	// ErrAlreadyExists is returned by StartTimer when the timer is running
+	ErrAlreadyExists = errors.New("timer already exists")
+	// ErrTimeoutOutOfRange is returned for a negative timeout or one beyond
+	// what the implementation can hold
+	ErrTimeoutOutOfRange = errors.New("timeout out of range")
+	// ErrClosed is returned once CloseTimer was called
+	ErrClosed = errors.New("timer closed")
+)
+
+// batchErrors is the result of StartTimers/StopTimers when the whole batch
+// failed with err
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func checkTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return ErrTimeoutOutOfRange
+	}
+	return nil
+}
+
+// number of expired receiptHandles remembered by recentExpiry
+const recentExpirySize = 1 << 16
+
+// recentExpiry remembers the last expired receiptHandles, so a call for a
+// timer which is gone can tell ErrAlreadyExpired from ErrNotFound
+type recentExpiry struct {
+	lock  sync.Mutex
+	index map[string]int
+	ring  []string
+	next  int
+}
+
+func (r *recentExpiry) add(receiptHandle string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.index == nil {
+		r.index = make(map[string]int)
+		r.ring = make([]string, recentExpirySize)
+	}
+	// drop the oldest one, unless it was added again since
+	if old := r.ring[r.next]; old != "" && r.index[old] == r.next {
+		delete(r.index, old)
+	}
+	r.ring[r.next] = receiptHandle
+	r.index[receiptHandle] = r.next
+	r.next = (r.next + 1) % recentExpirySize
+}
+
+// forget is called when a timer is started again for receiptHandle
+func (r *recentExpiry) forget(receiptHandle string) {
+	r.lock.Lock()
+	delete(r.index, receiptHandle)
+	r.lock.Unlock()
+}
+
+// missing returns the error for a receiptHandle without running timer
+func (r *recentExpiry) missing(receiptHandle string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.index[receiptHandle]; ok {
+		return ErrAlreadyExpired
+	}
+	return ErrNotFound
+}
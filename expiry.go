@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ExpiryHandler is called by TickProcess for every timer that expires.
+// It gets the receiptHandle together with the metadata saved at StartTimer,
+// this is where the message is resent or put into the DLQ.
+type ExpiryHandler interface {
+	TimerExpired(receiptHandle string, metadata msgMeta)
+}
+
+// ExpiryHandlerFunc lets an ordinary function be used as ExpiryHandler
+type ExpiryHandlerFunc func(receiptHandle string, metadata msgMeta)
+
+func (f ExpiryHandlerFunc) TimerExpired(receiptHandle string, metadata msgMeta) {
+	f(receiptHandle, metadata)
+}
+
+// used when no handler is configured, expired timers are simply dropped
+type discardExpiry struct{}
+
+func (discardExpiry) TimerExpired(receiptHandle string, metadata msgMeta) {}
+
+// QueueSink delivers the message of an expired timer to a queue
+type QueueSink interface {
+	SendMessage(queueURL string, receiptHandle string, metadata msgMeta) error
+}
+
+// a failed SendMessage is tried sendAttempts times in all, waiting
+// sendBackoff before the first retry and twice as long before each next one
+const (
+	sendAttempts = 3
+	sendBackoff  = 50 * time.Millisecond
+)
+
+// expiryRouter is the built-in ExpiryHandler. When Relcount > 0, the message
+// goes back to its original queue with Relcount decremented, otherwise it
+// goes to the DLQ. Without a DLQ the message is dropped. A message which
+// can't be sent after all is counted as undelivered in counters.
+type expiryRouter struct {
+	sink     QueueSink
+	counters *timerCounters
+}
+
+func routeExpiry(sink QueueSink, counters *timerCounters) ExpiryHandler {
+	return expiryRouter{sink, counters}
+}
+
+func (r expiryRouter) TimerExpired(receiptHandle string, metadata msgMeta) {
+	queue := metadata.Dlq
+	if metadata.Relcount > 0 {
+		metadata.Relcount--
+		queue = metadata.QURL
+	}
+	if queue == "" {
+		return
+	}
+	backoff := sendBackoff
+	for i := 1; ; i++ {
+		err := r.sink.SendMessage(queue, receiptHandle, metadata)
+		if err == nil {
+			return
+		}
+		if i == sendAttempts {
+			fmt.Printf("Failed to send %v to %v: %v\n", receiptHandle, queue, err)
+			r.counters.countUndelivered(1)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type queuedMsg struct {
+	ReceiptHandle string
+	Metadata      msgMeta
+}
+
+// in memory QueueSink, mainly for testing the routing without a queue service
+type memQueueSink struct {
+	lock   sync.Mutex
+	queues map[string][]queuedMsg
+}
+
+func newMemQueueSink() *memQueueSink {
+	return &memQueueSink{queues: make(map[string][]queuedMsg)}
+}
+
+func (s *memQueueSink) SendMessage(queueURL string, receiptHandle string, metadata msgMeta) error {
+	s.lock.Lock()
+	s.queues[queueURL] = append(s.queues[queueURL], queuedMsg{receiptHandle, metadata})
+	s.lock.Unlock()
+	return nil
+}
+
+// Messages returns a copy of everything sent to queueURL so far
+func (s *memQueueSink) Messages(queueURL string) []queuedMsg {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]queuedMsg(nil), s.queues[queueURL]...)
+}
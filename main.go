@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
@@ -9,39 +10,156 @@ import (
 
 type sampleData struct {
 	h string
-	t int
+	t time.Duration
+}
+
+// timerConfig is passed to InitTimer and holds settings common to all
+// timer implementations
+type timerConfig struct {
+	// Handler is called for each expired timer
+	Handler ExpiryHandler
+	// Sink is used for Relcount based redelivery/DLQ routing when Handler is
+	// nil. With neither of them expired timers are dropped.
+	Sink QueueSink
+	// Tick is how often TickProcess looks for expired timers, the default is
+	// one second. It is rounded down to milliseconds.
+	Tick time.Duration
+	// Duplicate decides what StartTimer does for a running receiptHandle
+	Duplicate dupPolicy
+	// CatchUp is what the persistent implementations do with the timers
+	// which became overdue while the process was down
+	CatchUp catchUpConfig
+	// Wheel and Persistence are the layout and the event store of the
+	// timerwheel, the other implementations ignore them
+	Wheel       wheelConfig
+	Persistence PersistenceSink
+	// Snapshots of the timerwheel are saved every SnapshotEvery (5 minutes
+	// by default), on restart only the events after the newest one are
+	// replayed
+	Snapshots     SnapshotStore
+	SnapshotEvery time.Duration
+}
+
+// dupPolicy is what StartTimer does when the receiptHandle has a running
+// timer already, all implementations behave the same way
+type dupPolicy int
+
+const (
+	DupReject       dupPolicy = iota // return ErrAlreadyExists, the default
+	DupReplace                       // replace deadline and metadata
+	DupKeepEarliest                  // keep the timer with the earlier deadline
+	DupKeepLatest                    // keep the timer with the later deadline
+)
+
+// replaces tells if a new timer with deadline newT takes the place of the
+// running one with deadline oldT. When it doesn't StartTimer does nothing.
+func (p dupPolicy) replaces(oldT, newT int64) (bool, error) {
+	switch p {
+	case DupReplace:
+		return true, nil
+	case DupKeepEarliest:
+		return newT < oldT, nil
+	case DupKeepLatest:
+		return newT > oldT, nil
+	}
+	return false, ErrAlreadyExists
+}
+
+func (c timerConfig) tick() time.Duration {
+	if c.Tick <= 0 {
+		return time.Second
+	}
+	if c.Tick < time.Millisecond {
+		return time.Millisecond
+	}
+	return c.Tick.Truncate(time.Millisecond)
+}
+
+// expiryHandler is the handler of the config, the messages the routing to
+// c.Sink fails to send are counted in counters
+func (c timerConfig) expiryHandler(counters *timerCounters) ExpiryHandler {
+	if c.Handler != nil {
+		return c.Handler
+	}
+	if c.Sink != nil {
+		return routeExpiry(c.Sink, counters)
+	}
+	return discardExpiry{}
 }
 
 type timert interface {
-	InitTimer() timert
-	StartTimer(receiptHandle string, timeout0 int, metadata msgMeta) error
-	StopTimer(receiptHandle string) error
-	TickProcess()
+	InitTimer(cfg timerConfig) timert
+	StartTimer(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) error
+	StopTimer(ctx context.Context, receiptHandle string) error
+	// ExtendTimer atomically moves the deadline of a running timer to timeout
+	// from now, like SQS ChangeMessageVisibility
+	ExtendTimer(ctx context.Context, receiptHandle string, timeout time.Duration) error
+	// GetTimer returns ErrNotFound when there's no running timer
+	GetTimer(ctx context.Context, receiptHandle string) (timerInfo, error)
+	// StartTimers and StopTimers do a whole batch in one transaction or round
+	// trip, the returned slice has the error for each item
+	StartTimers(ctx context.Context, timers []timerRequest) []error
+	StopTimers(ctx context.Context, receiptHandles []string) []error
+	// StartTimerAsync and StopTimerAsync don't wait for the backend, the
+	// future has the result once the change is persisted. Calls from one
+	// goroutine are applied in order.
+	StartTimerAsync(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) ackFuture
+	StopTimerAsync(ctx context.Context, receiptHandle string) ackFuture
+	// TickProcess runs the expiry process until ctx is canceled
+	TickProcess(ctx context.Context)
+	Stats() timerStats
 	PrintTimer()
 	CloseTimer()
 }
 
+// timerRequest is one item for StartTimers
+type timerRequest struct {
+	ReceiptHandle string
+	Timeout       time.Duration
+	Metadata      msgMeta
+}
+
 const sample = 1000000
 
-func tryoutTimer(ti timert) {
+// timers per StartTimers/StopTimers call, 1 uses StartTimer/StopTimer
+const batch = 1000
+
+func tryoutTimer(ti timert, cfg timerConfig) {
 	// generate sample data for testing. receiptHandle is base64 encoding
-	// timeout value is random value between 1~21
+	// timeout value is random value between 1ms~80s
 	var s [sample]sampleData
 	rand.Seed(time.Now().UnixNano())
 	for j := 0; j < sample; j++ {
-		sample_data := rand.Intn(80) + 1
+		sample_data := time.Duration(rand.Intn(80000)+1) * time.Millisecond
 		s[j].h = base64.StdEncoding.EncodeToString([]byte(time.Now().String()))
 		s[j].t = sample_data
 	}
 
-	ti = ti.InitTimer()
-	go ti.TickProcess()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ti = ti.InitTimer(cfg)
+	done := make(chan struct{})
+	go func() {
+		ti.TickProcess(ctx)
+		close(done)
+	}()
 	// use following as sample message data
 	mm := msgMeta{"dlq", "myqueue", 5, 0}
 	// start all sample timer
 	cur := time.Now()
-	for i := 0; i < sample; i++ {
-		ti.StartTimer(s[i].h, s[i].t, mm)
+	if batch > 1 {
+		reqs := make([]timerRequest, 0, batch)
+		for i := 0; i < sample; i++ {
+			reqs = append(reqs, timerRequest{s[i].h, s[i].t, mm})
+			if len(reqs) == batch || i == sample-1 {
+				ti.StartTimers(ctx, reqs)
+				reqs = reqs[:0]
+			}
+		}
+	} else {
+		for i := 0; i < sample; i++ {
+			ti.StartTimer(ctx, s[i].h, s[i].t, mm)
+		}
 	}
 	end := time.Now()
 	fmt.Printf("Create %d timer used %v\n", sample, end.Sub(cur))
@@ -49,8 +167,19 @@ func tryoutTimer(ti timert) {
 	time.Sleep(20 * time.Second)
 	// cancel all rest timer
 	cur = time.Now()
-	for i := 0; i < sample; i++ {
-		ti.StopTimer(s[i].h)
+	if batch > 1 {
+		handles := make([]string, 0, batch)
+		for i := 0; i < sample; i++ {
+			handles = append(handles, s[i].h)
+			if len(handles) == batch || i == sample-1 {
+				ti.StopTimers(ctx, handles)
+				handles = handles[:0]
+			}
+		}
+	} else {
+		for i := 0; i < sample; i++ {
+			ti.StopTimer(ctx, s[i].h)
+		}
 	}
 	end = time.Now()
 	fmt.Printf("Cancel %d timer used %v\n", sample, end.Sub(cur))
@@ -61,6 +190,8 @@ func tryoutTimer(ti timert) {
 	time.Sleep(11 * time.Second)
 	fmt.Printf("Now if there's still timer:\n")
 	ti.PrintTimer()
+	cancel()
+	<-done
 	ti.CloseTimer()
 }
 
@@ -68,7 +199,12 @@ func main() {
 	// var t *timerDB
 	// var t *timer
 	// var t *timerRedis
+	// var t *timerRedisZ
 	var t *timerwheel
 
-	tryoutTimer(t)
+	sink := newMemQueueSink()
+	// a fresh topic for each run, so nothing is replayed
+	kc := kafkaConfig{Topic: "perf-" + time.Now().Format("20060102150405")}
+	tryoutTimer(t, timerConfig{Sink: sink, Persistence: newKafkaSink(kc)})
+	fmt.Printf("Redelivered: %d, sent to dlq: %d\n", len(sink.Messages("myqueue")), len(sink.Messages("dlq")))
 }
@@ -1,35 +1,1330 @@
 package main
 
 import (
-	// "github.com/stretchr/testify/assert"
+	"context"
 	"encoding/base64"
-	// "fmt"
+	"errors"
+	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/buntdb"
 )
 
-func teststartstoptimer(t *testing.t) {
+func TestStartStopTimer(t *testing.T) {
 	// a := assert.new(t)
-	var s [1000000]sampledata
-	rand.seed(time.now().unixnano())
+	var s [1000000]sampleData
+	rand.Seed(time.Now().UnixNano())
 
 	for j := 0; j < 1000000; j++ {
-		sample_data := rand.intn(20) + 1
-		s[j].h = base64.stdencoding.encodetostring([]byte(time.now().string()))
+		sample_data := time.Duration(rand.Intn(20)+1) * time.Second
+		s[j].h = base64.StdEncoding.EncodeToString([]byte(time.Now().String()))
 		s[j].t = sample_data
 	}
-	ti := inittimer()
-	go ti.tickprocess()
-	mm := msgmeta{"dlq", "myqueue", 5, 0}
+	var tm *timer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ti := tm.InitTimer(timerConfig{})
+	go ti.TickProcess(ctx)
+	mm := msgMeta{"dlq", "myqueue", 5, 0}
 	for i := 0; i < 1000000; i++ {
 		// var s string
 		// s = fmt.sprintf("abc%d", i)
-		ti.starttimer(s[i].h, s[i].t, mm)
+		ti.StartTimer(ctx, s[i].h, s[i].t, mm)
 	}
-	time.sleep(7 * time.second)
+	time.Sleep(7 * time.Second)
 	for i := 0; i < 1000000; i++ {
-		ti.stoptimer(s[i].h)
+		ti.StopTimer(ctx, s[i].h)
+	}
+	ti.PrintTimer()
+}
+
+func TestExpiryHandler(t *testing.T) {
+	a := assert.New(t)
+	var lock sync.Mutex
+	got := make(map[string]msgMeta)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var tm *timer
+	ti := tm.InitTimer(timerConfig{
+		Handler: ExpiryHandlerFunc(func(receiptHandle string, metadata msgMeta) {
+			lock.Lock()
+			got[receiptHandle] = metadata
+			lock.Unlock()
+		}),
+		Tick: 10 * time.Millisecond,
+	})
+	go ti.TickProcess(ctx)
+	ti.StartTimer(ctx, "expire", 100*time.Millisecond, msgMeta{"dlq", "myqueue", 5, 0})
+	ti.StartTimer(ctx, "stop", 100*time.Millisecond, msgMeta{"dlq", "myqueue", 5, 0})
+	ti.StopTimer(ctx, "stop")
+	time.Sleep(300 * time.Millisecond)
+
+	s := ti.Stats()
+	a.Equal(uint64(2), s.Created)
+	a.Equal(uint64(1), s.Stopped)
+	a.Equal(uint64(1), s.Expired)
+	a.Equal(int64(0), s.Outstanding)
+	a.True(s.Ticks > 0)
+	lock.Lock()
+	defer lock.Unlock()
+	a.Len(got, 1)
+	a.Equal("myqueue", got["expire"].QURL)
+	a.Equal(5, got["expire"].Relcount)
+}
+
+func TestTickProcessCancel(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var tm *timer
+	ti := tm.InitTimer(timerConfig{})
+	done := make(chan struct{})
+	go func() {
+		ti.TickProcess(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TickProcess did not return after cancel")
+	}
+	a.Equal(context.Canceled, ti.StartTimer(ctx, "h", time.Second, msgMeta{}))
+}
+
+func TestSubSecondTimeout(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fired := make(chan time.Time, 1)
+	var tm *timer
+	ti := tm.InitTimer(timerConfig{
+		Handler: ExpiryHandlerFunc(func(receiptHandle string, metadata msgMeta) {
+			fired <- time.Now()
+		}),
+		Tick: 10 * time.Millisecond,
+	})
+	go ti.TickProcess(ctx)
+	start := time.Now()
+	ti.StartTimer(ctx, "h", 150*time.Millisecond, msgMeta{})
+	select {
+	case at := <-fired:
+		a.True(at.Sub(start) >= 150*time.Millisecond)
+		a.True(at.Sub(start) < 200*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
+
+// backend opens a timer of one implementation
+type backend struct {
+	name string
+	open func(t *testing.T, cfg timerConfig) timert
+}
+
+// backends are all implementations, the buntDB one in memory and the
+// timerwheel without a sink. The Redis ones are skipped when the Redis of
+// docker-compose.yml isn't running.
+var backends = []backend{
+	{"map", func(t *testing.T, cfg timerConfig) timert {
+		var tm *timer
+		return tm.InitTimer(cfg)
+	}},
+	{"buntdb", func(t *testing.T, cfg timerConfig) timert {
+		ti, err := newTimerDB(cfg, dbConfig{Path: ":memory:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ti
+	}},
+	{"wheel", func(t *testing.T, cfg timerConfig) timert {
+		var tw *timerwheel
+		return tw.InitTimer(cfg)
+	}},
+	{"redis", func(t *testing.T, cfg timerConfig) timert {
+		return newTimerRedis(cfg, redisTest(t))
+	}},
+	{"redisz", func(t *testing.T, cfg timerConfig) timert {
+		return newTimerRedisZ(cfg, redisTest(t))
+	}},
+}
+
+func TestExtendTimer(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var lock sync.Mutex
+			got := make(map[string]bool)
+			ti := b.open(t, timerConfig{
+				Handler: ExpiryHandlerFunc(func(receiptHandle string, metadata msgMeta) {
+					lock.Lock()
+					got[receiptHandle] = true
+					lock.Unlock()
+				}),
+				Tick: 10 * time.Millisecond,
+			})
+			defer ti.CloseTimer()
+			go ti.TickProcess(ctx)
+			a.NoError(ti.StartTimer(ctx, "h", 100*time.Millisecond, msgMeta{}))
+			a.NoError(ti.ExtendTimer(ctx, "h", 300*time.Millisecond))
+			a.Equal(ErrNotFound, ti.ExtendTimer(ctx, "unknown", time.Second))
+			info, err := ti.GetTimer(ctx, "h")
+			a.NoError(err)
+			a.True(info.Remaining > 200*time.Millisecond && info.Remaining <= 300*time.Millisecond)
+			a.Equal(toMillis(info.Deadline), info.Metadata.Timeout)
+			_, err = ti.GetTimer(ctx, "unknown")
+			a.Equal(ErrNotFound, err)
+
+			time.Sleep(200 * time.Millisecond)
+			lock.Lock()
+			a.False(got["h"])
+			lock.Unlock()
+			a.Eventually(func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return got["h"]
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestExpiryRouting(t *testing.T) {
+	a := assert.New(t)
+	sink := newMemQueueSink()
+	r := routeExpiry(sink, &timerCounters{})
+	r.TimerExpired("h1", msgMeta{"dlq", "myqueue", 2, 0})
+	r.TimerExpired("h2", msgMeta{"dlq", "myqueue", 0, 0})
+	r.TimerExpired("h3", msgMeta{"", "myqueue", 0, 0})
+
+	q := sink.Messages("myqueue")
+	a.Len(q, 1)
+	a.Equal("h1", q[0].ReceiptHandle)
+	a.Equal(1, q[0].Metadata.Relcount)
+	d := sink.Messages("dlq")
+	a.Len(d, 1)
+	a.Equal("h2", d[0].ReceiptHandle)
+}
+
+// flakySink fails the first fails sends
+type flakySink struct {
+	*memQueueSink
+	fails int
+}
+
+func (s *flakySink) SendMessage(queueURL string, receiptHandle string, metadata msgMeta) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	return s.memQueueSink.SendMessage(queueURL, receiptHandle, metadata)
+}
+
+func TestExpiryRetry(t *testing.T) {
+	a := assert.New(t)
+	var c timerCounters
+	sink := &flakySink{newMemQueueSink(), sendAttempts - 1}
+	r := routeExpiry(sink, &c)
+	r.TimerExpired("h1", msgMeta{"dlq", "", 0, 0})
+	a.Len(sink.Messages("dlq"), 1)
+	a.Zero(c.stats(0).Undelivered)
+
+	sink.fails = sendAttempts
+	r.TimerExpired("h2", msgMeta{"dlq", "", 0, 0})
+	a.Len(sink.Messages("dlq"), 1)
+	a.Equal(uint64(1), c.stats(0).Undelivered)
+}
+
+func TestTickHistogram(t *testing.T) {
+	a := assert.New(t)
+	var h tickHistogram
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Microsecond)
+	}
+	a.InEpsilon(float64(500*time.Microsecond), float64(h.quantile(0.5)), 0.125)
+	a.InEpsilon(float64(990*time.Microsecond), float64(h.quantile(0.99)), 0.125)
+	a.Equal(1000*time.Microsecond, h.max)
+	a.True(h.quantile(0.99) <= h.max)
+}
+
+func TestTimerErrors(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ti := b.open(t, timerConfig{Tick: 10 * time.Millisecond})
+			go ti.TickProcess(ctx)
+			a.NoError(ti.StartTimer(ctx, "h", 50*time.Millisecond, msgMeta{}))
+			a.True(errors.Is(ti.StartTimer(ctx, "h", time.Second, msgMeta{}), ErrAlreadyExists))
+			a.True(errors.Is(ti.StartTimer(ctx, "n", -time.Second, msgMeta{}), ErrTimeoutOutOfRange))
+			a.True(errors.Is(ti.StopTimer(ctx, "unknown"), ErrNotFound))
+			a.Eventually(func() bool {
+				_, err := ti.GetTimer(ctx, "h")
+				return errors.Is(err, ErrAlreadyExpired)
+			}, time.Second, 10*time.Millisecond)
+			a.True(errors.Is(ti.StopTimer(ctx, "h"), ErrAlreadyExpired))
+			a.Equal(uint64(1), ti.Stats().StopAfterExpiry)
+
+			ti.CloseTimer()
+			a.True(errors.Is(ti.StartTimer(ctx, "h", time.Second, msgMeta{}), ErrClosed))
+			_, err := ti.GetTimer(ctx, "h")
+			a.True(errors.Is(err, ErrClosed))
+		})
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctx := context.Background()
+			deadline := func(ti timert) time.Duration {
+				info, err := ti.GetTimer(ctx, "h")
+				a.NoError(err)
+				return info.Remaining.Round(time.Second)
+			}
+			for _, c := range []struct {
+				policy dupPolicy
+				want   time.Duration
+				err    error
+			}{
+				{DupReject, 20 * time.Second, ErrAlreadyExists},
+				{DupReplace, 10 * time.Second, nil},
+				{DupKeepEarliest, 10 * time.Second, nil},
+				{DupKeepLatest, 30 * time.Second, nil},
+			} {
+				ti := b.open(t, timerConfig{Duplicate: c.policy})
+				a.NoError(ti.StartTimer(ctx, "h", 20*time.Second, msgMeta{}))
+				a.Equal(c.err, ti.StartTimer(ctx, "h", 10*time.Second, msgMeta{}))
+				a.Equal(c.err, ti.StartTimer(ctx, "h", 30*time.Second, msgMeta{}))
+				if c.policy == DupReplace {
+					a.NoError(ti.StartTimer(ctx, "h", 10*time.Second, msgMeta{}))
+				}
+				a.Equal(c.want, deadline(ti), "policy %v", c.policy)
+				a.Equal(uint64(1), ti.Stats().Created)
+				ti.CloseTimer()
+			}
+		})
+	}
+}
+
+func TestBatchTimers(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			a := assert.New(t)
+			ctx := context.Background()
+			ti := b.open(t, timerConfig{})
+			defer ti.CloseTimer()
+			errs := ti.StartTimers(ctx, []timerRequest{
+				{"a", time.Minute, msgMeta{}},
+				{"b", -time.Second, msgMeta{}},
+				{"a", time.Minute, msgMeta{}},
+			})
+			a.Equal([]error{nil, ErrTimeoutOutOfRange, ErrAlreadyExists}, errs)
+			a.Equal(int64(1), ti.Stats().Outstanding)
+			errs = ti.StopTimers(ctx, []string{"a", "b"})
+			a.Equal([]error{nil, ErrNotFound}, errs)
+			a.Equal(int64(0), ti.Stats().Outstanding)
+		})
+	}
+}
+
+func TestWheelLayout(t *testing.T) {
+	// 2 levels of 4 slots hold 160ms, one level holds 40ms, the rest goes
+	// to the overflow bucket
+	for _, wc := range []wheelConfig{{Slots: 4, Levels: 2}, {Slots: 4, Levels: 1}} {
+		wc := wc
+		t.Run(fmt.Sprintf("levels %d", wc.Levels), func(t *testing.T) {
+			a := assert.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var lock sync.Mutex
+			fired := make(map[string]time.Time)
+			start := time.Now()
+			ti := newTimerwheel(timerConfig{
+				Tick:  10 * time.Millisecond,
+				Wheel: wc,
+				Handler: ExpiryHandlerFunc(func(h string, m msgMeta) {
+					lock.Lock()
+					fired[h] = time.Now()
+					lock.Unlock()
+				}),
+			})
+			defer ti.CloseTimer()
+			go ti.TickProcess(ctx)
+			timeouts := map[string]time.Duration{"a": 30 * time.Millisecond, "b": 120 * time.Millisecond, "c": 500 * time.Millisecond}
+			for h, d := range timeouts {
+				a.NoError(ti.StartTimer(ctx, h, d, msgMeta{}))
+			}
+			time.Sleep(700 * time.Millisecond)
+			lock.Lock()
+			defer lock.Unlock()
+			for h, d := range timeouts {
+				at, ok := fired[h]
+				if a.True(ok, h) {
+					a.True(at.Sub(start) >= d, h)
+					a.True(at.Sub(start) < d+100*time.Millisecond, h)
+				}
+			}
+		})
 	}
-	ti.printtimer()
+}
+
+func TestWheelReplay(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fired := make(chan string, 3)
+	ti := newTimerwheel(timerConfig{
+		Tick: 10 * time.Millisecond,
+		Handler: ExpiryHandlerFunc(func(h string, m msgMeta) {
+			fired <- h
+		}),
+	})
+	defer ti.CloseTimer()
+	now := time.Now()
+	for _, ev := range []persistEvent{
+		{Start: &startEvent{ID: "running", Timeout: now.Add(time.Second)}},
+		{Start: &startEvent{ID: "extended", Timeout: now.Add(time.Second)}},
+		{Start: &startEvent{ID: "extended", Timeout: now.Add(time.Minute)}},
+		{Start: &startEvent{ID: "stopped", Timeout: now.Add(time.Second)}},
+		{Stop: "stopped"},
+		{Start: &startEvent{ID: "expired", Timeout: now.Add(-time.Minute)}},
+		{Expire: "expired"},
+		{Start: &startEvent{ID: "overdue", Timeout: now.Add(-time.Minute)}},
+	} {
+		ti.replay(ev)
+	}
+	info, err := ti.GetTimer(ctx, "extended")
+	a.NoError(err)
+	a.True(info.Remaining > 50*time.Second)
+	a.True(errors.Is(ti.StopTimer(ctx, "stopped"), ErrNotFound))
+	a.True(errors.Is(ti.StopTimer(ctx, "expired"), ErrAlreadyExpired))
+	a.Equal(int64(3), ti.Stats().Outstanding)
+
+	// the deadline passed while down, it fires right away
+	go ti.TickProcess(ctx)
+	select {
+	case h := <-fired:
+		a.Equal("overdue", h)
+	case <-time.After(time.Second):
+		a.Fail("overdue timer did not fire")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "timers.log")
+	var tw *timerwheel
+	var sink *fileSink
+	open := func() timert {
+		var err error
+		sink, err = newFileSink(path)
+		a.NoError(err)
+		return tw.InitTimer(timerConfig{Persistence: sink})
+	}
+	ti := open()
+	a.Equal([]error{nil, nil, nil}, ti.StartTimers(ctx, []timerRequest{
+		{"a", time.Minute, msgMeta{QURL: "q"}},
+		{"b", time.Minute, msgMeta{}},
+		{"c", time.Minute, msgMeta{}},
+	}))
+	a.NoError(ti.StopTimer(ctx, "b"))
+	a.NoError(ti.ExtendTimer(ctx, "c", time.Hour))
+	offsets, err := sink.Offsets(ctx)
+	a.NoError(err)
+	ti.CloseTimer()
+	fi, err := os.Stat(path)
+	a.NoError(err)
+	a.Equal(map[int]int64{0: fi.Size()}, offsets)
+
+	// a torn write at the end is dropped, the offset stays in front of it
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	a.NoError(err)
+	_, err = f.WriteString(`{"Stop":"a`)
+	a.NoError(err)
+	a.NoError(f.Close())
+
+	ti = open()
+	defer ti.CloseTimer()
+	reopened, err := sink.Offsets(ctx)
+	a.NoError(err)
+	a.Equal(offsets, reopened)
+	info, err := ti.GetTimer(ctx, "a")
+	a.NoError(err)
+	a.Equal("q", info.Metadata.QURL)
+	_, err = ti.GetTimer(ctx, "b")
+	a.True(errors.Is(err, ErrNotFound))
+	info, err = ti.GetTimer(ctx, "c")
+	a.NoError(err)
+	a.True(info.Remaining > 50*time.Minute)
+	a.Equal(int64(2), ti.Stats().Outstanding)
+}
+
+func TestKafkaMessage(t *testing.T) {
+	a := assert.New(t)
+	deadline := fromMillis(toMillis(time.Now()))
+	for _, ev := range []persistEvent{
+		{Start: &startEvent{ID: "a", Timeout: deadline, Metadata: msgMeta{QURL: "q", Timeout: toMillis(deadline)}}},
+		{Stop: "a"},
+		{Expire: "a"},
+	} {
+		msg, err := kafkaMessage(ev)
+		a.NoError(err)
+		a.Equal([]byte("a"), msg.Key)
+		if ev.Start == nil {
+			a.Nil(msg.Value, "tombstone")
+		}
+		got, err := kafkaEvent(msg)
+		a.NoError(err)
+		if ev.Start != nil {
+			a.True(ev.Start.Timeout.Equal(got.Start.Timeout))
+			a.Equal(ev.Start.Metadata, got.Start.Metadata)
+		} else {
+			a.Equal(ev, got)
+		}
+	}
+}
+
+func TestAsyncQueue(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	var tm *timer
+	ti := tm.InitTimer(timerConfig{})
+	defer ti.CloseTimer()
+	q := newAsyncQueue(ti)
+	// the futures are waited for at the end, the calls still run in order
+	acks := []ackFuture{
+		q.start(ctx, timerRequest{"a", time.Minute, msgMeta{}}),
+		q.start(ctx, timerRequest{"b", time.Minute, msgMeta{}}),
+		q.stop(ctx, "a"),
+		q.stop(ctx, "a"),
+		q.start(ctx, timerRequest{"a", time.Minute, msgMeta{}}),
+	}
+	var errs []error
+	for _, ack := range acks {
+		errs = append(errs, ack.Wait(ctx))
+	}
+	a.Equal([]error{nil, nil, nil, ErrNotFound, nil}, errs)
+	a.Equal(int64(2), ti.Stats().Outstanding)
+
+	q.close()
+	a.Equal(ErrClosed, q.stop(ctx, "a").Wait(ctx))
+}
+
+// batchCounter records the size of each StartTimers call, which takes a
+// while like a round trip would
+type batchCounter struct {
+	timert
+	lock    sync.Mutex
+	batches []int
+}
+
+func (b *batchCounter) StartTimers(ctx context.Context, timers []timerRequest) []error {
+	b.lock.Lock()
+	b.batches = append(b.batches, len(timers))
+	b.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	return b.timert.StartTimers(ctx, timers)
+}
+
+func TestAsyncQueueBatches(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	var tm *timer
+	b := &batchCounter{timert: tm.InitTimer(timerConfig{})}
+	q := newAsyncQueue(b)
+	defer q.close()
+	// the calls don't wait for the rounds, whatever comes in while one runs
+	// makes the next
+	st := time.Now()
+	acks := make([]ackFuture, 200)
+	for i := range acks {
+		acks[i] = q.start(ctx, timerRequest{strconv.Itoa(i), time.Minute, msgMeta{}})
+	}
+	a.True(time.Since(st) < 50*time.Millisecond)
+	for _, ack := range acks {
+		a.NoError(ack.Wait(ctx))
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	a.True(len(b.batches) <= 3, "%v", b.batches)
+	a.Equal(int64(200), b.Stats().Outstanding)
+}
+
+func TestKafkaUnreachable(t *testing.T) {
+	a := assert.New(t)
+	sink := newKafkaSink(kafkaConfig{
+		Addr:     "127.0.0.1:1",
+		Backoff:  10 * time.Millisecond,
+		Deadline: 200 * time.Millisecond,
+	})
+	state, _ := sink.State()
+	a.Equal(SinkConnecting, state)
+	var tw *timerwheel
+	ti := tw.InitTimer(timerConfig{Persistence: sink})
+	state, err := sink.State()
+	a.Equal(SinkFailed, state)
+	a.Error(err)
+	a.True(errors.Is(ti.StartTimer(context.Background(), "a", time.Second, msgMeta{}), ErrClosed))
+}
+
+func TestKafkaPartition(t *testing.T) {
+	a := assert.New(t)
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		id := timerID(strconv.Itoa(i))
+		p := kafkaPartition(id, 8)
+		a.Equal(p, kafkaPartition(id, 8))
+		a.True(p >= 0 && p < 8)
+		used[p] = true
+	}
+	a.Len(used, 8)
+
+	ack, done := newAck()
+	acks := splitAck(done, 3)
+	acks[0](nil)
+	acks[1](ErrClosed)
+	select {
+	case <-ack:
+		a.Fail("acked before all parts")
+	default:
+	}
+	acks[2](nil)
+	a.Equal(ErrClosed, ack.Wait(context.Background()))
+}
+
+// countingSink counts the replayed events
+type countingSink struct {
+	*fileSink
+	replayed int
+}
+
+func (s *countingSink) Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error {
+	return s.fileSink.Replay(ctx, from, func(ev persistEvent) {
+		s.replayed++
+		fn(ev)
+	})
+}
+
+// failingSink fails the next fail appends and keeps nothing
+type failingSink struct {
+	nopSink
+	lock sync.Mutex
+	fail int
+}
+
+func (s *failingSink) failNext(n int) {
+	s.lock.Lock()
+	s.fail = n
+	s.lock.Unlock()
+}
+
+func (s *failingSink) Append(events ...persistEvent) ackFuture {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return doneAck(errors.New("write failed"))
+	}
+	return doneAck(nil)
+}
+
+// recordingSink keeps the appended events in memory, Append takes a while
+// like a real sink before the events are queued
+type recordingSink struct {
+	nopSink
+	lock   sync.Mutex
+	events []persistEvent
+}
+
+func (s *recordingSink) Append(events ...persistEvent) ackFuture {
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	s.lock.Lock()
+	s.events = append(s.events, events...)
+	s.lock.Unlock()
+	return doneAck(nil)
+}
+
+func (s *recordingSink) Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error {
+	for _, ev := range s.events {
+		fn(ev)
+	}
+	return nil
+}
+
+// the events replay to the state the wheel had, concurrent starts and stops
+// of the same timers are appended in the order they were applied
+func TestWheelEventOrder(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	sink := &recordingSink{}
+	var tw *timerwheel
+	handles := []string{"a", "b", "c", "d"}
+	state := func(ti timert) map[string]int64 {
+		m := make(map[string]int64)
+		for _, h := range handles {
+			if info, err := ti.GetTimer(ctx, h); err == nil {
+				m[h] = info.Metadata.Timeout
+			}
+		}
+		return m
+	}
+	ti := tw.InitTimer(timerConfig{Persistence: sink})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				h := handles[(g+i)%len(handles)]
+				if (g+i)%3 == 0 {
+					ti.StopTimer(ctx, h)
+				} else {
+					ti.StartTimer(ctx, h, time.Duration(g*1000+i)*time.Millisecond+time.Hour, msgMeta{})
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	want := state(ti)
+	ti.CloseTimer()
+
+	ti = tw.InitTimer(timerConfig{Persistence: sink})
+	defer ti.CloseTimer()
+	a.Equal(want, state(ti))
+}
+
+func TestWheelPersistFailure(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &failingSink{}
+	fired := make(chan string, 2)
+	var tw *timerwheel
+	ti := tw.InitTimer(timerConfig{
+		Tick:        10 * time.Millisecond,
+		Persistence: sink,
+		Handler: ExpiryHandlerFunc(func(receiptHandle string, metadata msgMeta) {
+			fired <- receiptHandle
+		}),
+	})
+	defer ti.CloseTimer()
+	go ti.TickProcess(ctx)
+	a.NoError(ti.StartTimer(ctx, "a", 50*time.Millisecond, msgMeta{}))
+	// the expiry of a isn't persisted, it fires anyway and the ticks go on
+	sink.failNext(1)
+	select {
+	case h := <-fired:
+		a.Equal("a", h)
+	case <-time.After(time.Second):
+		t.Fatal("a did not fire")
+	}
+	a.NoError(ti.StartTimer(ctx, "b", 50*time.Millisecond, msgMeta{}))
+	select {
+	case h := <-fired:
+		a.Equal("b", h)
+	case <-time.After(time.Second):
+		t.Fatal("b did not fire after the sink recovered")
+	}
+	a.Equal(uint64(2), ti.Stats().Expired)
+}
+
+func TestWheelRollback(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	sink := &failingSink{}
+	var tw *timerwheel
+	ti := tw.InitTimer(timerConfig{Persistence: sink, Duplicate: DupReplace})
+	defer ti.CloseTimer()
+
+	// a start which isn't persisted isn't armed either
+	sink.failNext(1)
+	a.Error(ti.StartTimer(ctx, "x", time.Minute, msgMeta{}))
+	_, err := ti.GetTimer(ctx, "x")
+	a.True(errors.Is(err, ErrNotFound))
+
+	a.NoError(ti.StartTimer(ctx, "y", time.Minute, msgMeta{QURL: "q"}))
+	before, _ := ti.GetTimer(ctx, "y")
+	// a failed replace, extend or stop leaves the timer as it was
+	sink.failNext(3)
+	a.Error(ti.StartTimer(ctx, "y", time.Hour, msgMeta{QURL: "r"}))
+	a.Error(ti.ExtendTimer(ctx, "y", time.Hour))
+	a.Error(ti.StopTimer(ctx, "y"))
+	after, err := ti.GetTimer(ctx, "y")
+	a.NoError(err)
+	a.Equal(before.Metadata, after.Metadata)
+
+	sink.failNext(1)
+	errs := ti.StartTimers(ctx, []timerRequest{{"z1", time.Minute, msgMeta{}}, {"z2", time.Minute, msgMeta{}}})
+	a.Error(errs[0])
+	a.Error(errs[1])
+	s := ti.Stats()
+	a.Equal(int64(1), s.Outstanding)
+	a.Equal(uint64(1), s.Created)
+	a.Equal(uint64(0), s.Stopped)
+}
+
+func TestSnapshot(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	var tw *timerwheel
+	open := func() (*timerwheel, *countingSink) {
+		fs, err := newFileSink(filepath.Join(dir, "timers.log"))
+		a.NoError(err)
+		sink := &countingSink{fileSink: fs}
+		ti := tw.InitTimer(timerConfig{
+			Persistence: sink,
+			Snapshots:   newFileSnapshots(filepath.Join(dir, "snapshot.json")),
+		})
+		return ti.(*timerwheel), sink
+	}
+	ti, _ := open()
+	a.NoError(ti.StartTimer(ctx, "a", time.Minute, msgMeta{}))
+	a.NoError(ti.StartTimer(ctx, "b", time.Minute, msgMeta{QURL: "q"}))
+	a.NoError(ti.snapshot(ctx))
+	a.NoError(ti.StopTimer(ctx, "a"))
+	a.NoError(ti.StartTimer(ctx, "c", time.Minute, msgMeta{}))
+	ti.CloseTimer()
+
+	ti, sink := open()
+	defer ti.CloseTimer()
+	// only the stop and start after the snapshot are replayed
+	a.Equal(2, sink.replayed)
+	a.Equal(int64(2), ti.Stats().Outstanding)
+	_, err := ti.GetTimer(ctx, "a")
+	a.True(errors.Is(err, ErrNotFound))
+	info, err := ti.GetTimer(ctx, "b")
+	a.NoError(err)
+	a.Equal("q", info.Metadata.QURL)
+	_, err = ti.GetTimer(ctx, "c")
+	a.NoError(err)
+}
+
+func TestTimerDBConfig(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	first := dbConfig{Path: filepath.Join(dir, "first.db"), Sync: DBSyncAlways, Index: "deadline"}
+	t1, err := newTimerDB(timerConfig{}, first)
+	a.NoError(err)
+	t2, err := newTimerDB(timerConfig{}, dbConfig{Path: ":memory:"})
+	a.NoError(err)
+	defer t2.CloseTimer()
+	a.NoError(t1.StartTimer(ctx, "h", time.Minute, msgMeta{}))
+	a.NoError(t2.StartTimer(ctx, "h", time.Minute, msgMeta{}))
+	a.NoError(t2.StopTimer(ctx, "h"))
+	t1.CloseTimer()
+
+	t1, err = newTimerDB(timerConfig{}, first)
+	a.NoError(err)
+	defer t1.CloseTimer()
+	_, err = t1.GetTimer(ctx, "h")
+	a.NoError(err)
+
+	_, err = newTimerDB(timerConfig{}, dbConfig{Path: filepath.Join(dir, "missing", "x.db")})
+	a.Error(err)
+}
+
+// a db of the versions with deadlines in seconds is converted on open
+func TestTimerDBClosed(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	ti := closedTimerDB(timerConfig{})
+	a.Equal(ErrClosed, ti.StartTimer(ctx, "h", time.Second, msgMeta{}))
+	a.Equal(ErrClosed, ti.StopTimer(ctx, "h"))
+	_, err := ti.GetTimer(ctx, "h")
+	a.Equal(ErrClosed, err)
+	a.Equal(ErrClosed, ti.StartTimerAsync(ctx, "h", time.Second, msgMeta{}).Wait(ctx))
+	ti.TickProcess(ctx) // returns right away
+	ti.CloseTimer()
+}
+
+func TestTimerDBSeconds(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := buntdb.Open(path)
+	a.NoError(err)
+	a.NoError(db.Update(func(tx *buntdb.Tx) error {
+		tx.Set("old", fmt.Sprintf(`{"QURL":"q","Timeout":%d}`, time.Now().Unix()+3600), nil)
+		tx.Set("new", fmt.Sprintf(`{"Timeout":%d}`, toMillis(time.Now())+7200000), nil)
+		return nil
+	}))
+	a.NoError(db.Close())
+
+	ti, err := newTimerDB(timerConfig{}, dbConfig{Path: path})
+	a.NoError(err)
+	defer ti.CloseTimer()
+	info, err := ti.GetTimer(ctx, "old")
+	a.NoError(err)
+	a.Equal("q", info.Metadata.QURL)
+	a.InDelta(float64(time.Hour), float64(info.Remaining), float64(2*time.Second))
+	info, err = ti.GetTimer(ctx, "new")
+	a.NoError(err)
+	a.InDelta(float64(2*time.Hour), float64(info.Remaining), float64(2*time.Second))
+}
+
+func TestCatchUp(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	// timers which became overdue while down, and one which isn't yet
+	prepare := func(path string) {
+		ti, err := newTimerDB(timerConfig{}, dbConfig{Path: path})
+		a.NoError(err)
+		for _, h := range []string{"a", "b", "c"} {
+			a.NoError(ti.StartTimer(ctx, h, 10*time.Millisecond, msgMeta{}))
+		}
+		a.NoError(ti.StartTimer(ctx, "later", time.Minute, msgMeta{}))
+		ti.CloseTimer()
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, policy := range []catchUpPolicy{CatchUpFire, CatchUpSpread, CatchUpDrop} {
+		path := filepath.Join(dir, fmt.Sprintf("%d.db", policy))
+		prepare(path)
+		var lock sync.Mutex
+		var fired, dropped []time.Time
+		record := func(to *[]time.Time) ExpiryHandler {
+			return ExpiryHandlerFunc(func(h string, m msgMeta) {
+				lock.Lock()
+				*to = append(*to, time.Now())
+				lock.Unlock()
+			})
+		}
+		ti, err := newTimerDB(timerConfig{
+			Tick:    10 * time.Millisecond,
+			Handler: record(&fired),
+			CatchUp: catchUpConfig{Policy: policy, Window: 300 * time.Millisecond, Dropped: record(&dropped)},
+		}, dbConfig{Path: path})
+		a.NoError(err)
+		st := time.Now()
+		go ti.TickProcess(ctx)
+		time.Sleep(500 * time.Millisecond)
+		ti.CloseTimer()
+
+		lock.Lock()
+		switch policy {
+		case CatchUpFire:
+			a.Len(fired, 3)
+			a.True(fired[2].Sub(st) < 100*time.Millisecond)
+		case CatchUpSpread:
+			a.Len(fired, 3)
+			a.True(fired[2].Sub(st) > 150*time.Millisecond)
+		case CatchUpDrop:
+			a.Len(fired, 0)
+			a.Len(dropped, 3)
+			a.Equal(uint64(3), ti.Stats().Dropped)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestRedisKeys(t *testing.T) {
+	a := assert.New(t)
+	// no server is needed, go-redis connects on the first command
+	ti := newTimerRedis(timerConfig{Tick: 100 * time.Millisecond}, redisConfig{Addr: "127.0.0.1:1", Prefix: "dep1:"})
+	defer ti.CloseTimer()
+	for _, k := range []string{
+		ti.keys.timer("h"), ti.slotKey(17), ti.keys.expired("h"), ti.keys.progress(),
+		ti.keys.zTimers(), ti.keys.zDeadlines(),
+	} {
+		a.True(strings.HasPrefix(k, "dep1:"), k)
+	}
+	a.Equal("dep1:s:1700", ti.slotKey(17))
+	a.Equal(redisKeys("timer:"), redisConfig{}.keys())
+	// a receiptHandle can't be mistaken for another kind of key
+	a.NotEqual(ti.keys.timer("progress"), ti.keys.progress())
+	a.Equal(`a\*\?\[1\]\\:[0-9]*`, match(`a*?[1]\:`, "[0-9]*"))
+}
+
+// redisTest returns a config for the Redis of docker-compose.yml with a
+// prefix of the test's own, the test is skipped when it's not running. The
+// keys are removed at the end.
+func redisTest(t *testing.T) redisConfig {
+	rc := redisConfig{Prefix: "test:" + t.Name() + ":" + strconv.FormatInt(time.Now().UnixNano(), 36) + ":"}
+	rdb := rc.client()
+	ctx := context.Background()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		t.Skipf("redis not reachable: %v", err)
+	}
+	t.Cleanup(func() {
+		keys, _ := rdb.Keys(ctx, rc.Prefix+"*").Result()
+		if len(keys) > 0 {
+			rdb.Del(ctx, keys...)
+		}
+		rdb.Close()
+	})
+	return rc
+}
+
+// the scans of a prefix with glob characters only see its own keys
+func TestRedisGlobPrefix(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx := context.Background()
+	glob, plain := rc, rc
+	glob.Prefix += "[1]:"
+	plain.Prefix += "1:"
+	t1 := newTimerRedis(timerConfig{}, glob)
+	defer t1.CloseTimer()
+	t2 := newTimerRedis(timerConfig{}, plain)
+	defer t2.CloseTimer()
+	a.NoError(t1.StartTimer(ctx, "a", time.Minute, msgMeta{}))
+	a.NoError(t2.StartTimer(ctx, "b", time.Hour, msgMeta{}))
+	info, err := t1.GetTimer(ctx, "a")
+	a.NoError(err)
+	var slots []int64
+	a.NoError(scanSlotSets(ctx, t1.rdb, t1.keys, func(ms int64) error {
+		slots = append(slots, ms)
+		return nil
+	}))
+	a.Equal([]int64{tickSlot(info.Metadata.Timeout, t1.tick) * int64(t1.tick/time.Millisecond)}, slots)
+}
+
+func TestRedisStats(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx := context.Background()
+	t1 := newTimerRedis(timerConfig{}, rc)
+	defer t1.CloseTimer()
+	for _, h := range []string{"a", "b", "c"} {
+		a.NoError(t1.StartTimer(ctx, h, time.Minute, msgMeta{}))
+	}
+	a.Equal(ErrAlreadyExists, t1.StartTimer(ctx, "a", time.Minute, msgMeta{}))
+	// another process sharing the prefix sees the same timers
+	t2 := newTimerRedis(timerConfig{}, rc)
+	defer t2.CloseTimer()
+	a.NoError(t2.StopTimer(ctx, "b"))
+	a.Equal(ErrNotFound, t2.StopTimer(ctx, "b"))
+	a.Equal(int64(2), t1.Stats().Outstanding)
+	a.Equal(int64(2), t2.Stats().Outstanding)
+	a.Equal(uint64(0), t2.Stats().Created)
+}
+
+// firedCounter counts the expired timers by receiptHandle
+type firedCounter struct {
+	lock  sync.Mutex
+	fired map[string]int
+}
+
+func (f *firedCounter) TimerExpired(receiptHandle string, metadata msgMeta) {
+	f.lock.Lock()
+	if f.fired == nil {
+		f.fired = make(map[string]int)
+	}
+	f.fired[receiptHandle]++
+	f.lock.Unlock()
+}
+
+func (f *firedCounter) count() (handles, calls int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, n := range f.fired {
+		calls += n
+	}
+	return len(f.fired), calls
+}
+
+// waitFired waits up to d for n timers to fire
+func (f *firedCounter) waitFired(n int, d time.Duration) bool {
+	for end := time.Now().Add(d); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if handles, _ := f.count(); handles >= n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRedisClaim(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &firedCounter{}
+	ti := newTimerRedis(timerConfig{Tick: 50 * time.Millisecond, Handler: f}, rc)
+	defer ti.CloseTimer()
+	// more than one claim batch in the same slot
+	reqs := make([]timerRequest, claimBatch+5)
+	for i := range reqs {
+		reqs[i] = timerRequest{strconv.Itoa(i), 200 * time.Millisecond, msgMeta{}}
+	}
+	for _, err := range ti.StartTimers(ctx, reqs) {
+		a.NoError(err)
+	}
+	info, err := ti.GetTimer(ctx, "1")
+	a.NoError(err)
+	slot := ti.slotKey(tickSlot(toMillis(info.Deadline), ti.tick))
+	// a stop takes the handle out of its slot set too
+	a.NoError(ti.StopTimer(ctx, "0"))
+	a.Equal([]error{nil, ErrNotFound}, ti.StopTimers(ctx, []string{"2", "2"}))
+	isMember := func(h string) bool {
+		ok, err := ti.rdb.SIsMember(ctx, slot, h).Result()
+		a.NoError(err)
+		return ok
+	}
+	a.False(isMember("0"))
+	a.False(isMember("2"))
+	a.True(isMember("1"))
+
+	go ti.TickProcess(ctx)
+	a.True(f.waitFired(claimBatch+3, 2*time.Second))
+	handles, calls := f.count()
+	a.Equal(claimBatch+3, handles)
+	a.Equal(claimBatch+3, calls)
+	a.Equal(int64(0), ti.Stats().Outstanding)
+	_, err = ti.GetTimer(ctx, "1")
+	a.Equal(ErrAlreadyExpired, err)
+	a.Equal(ErrAlreadyExpired, ti.StopTimer(ctx, "1"))
+	n, err := ti.rdb.Exists(ctx, slot).Result()
+	a.NoError(err)
+	a.Equal(int64(0), n)
+}
+
+func TestRedisZ(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &firedCounter{}
+	ti := newTimerRedisZ(timerConfig{Tick: 20 * time.Millisecond, Handler: f}, rc)
+	defer ti.CloseTimer()
+	// early is started first, so it's due before the batch however slow
+	// the pipeline is
+	a.NoError(ti.StartTimer(ctx, "early", 100*time.Millisecond, msgMeta{}))
+	reqs := make([]timerRequest, claimBatch+5)
+	for i := range reqs {
+		reqs[i] = timerRequest{strconv.Itoa(i), 500 * time.Millisecond, msgMeta{}}
+	}
+	for _, err := range ti.StartTimers(ctx, reqs) {
+		a.NoError(err)
+	}
+	a.NoError(ti.StartTimer(ctx, "late", time.Hour, msgMeta{}))
+	a.NoError(ti.StopTimer(ctx, "0"))
+	a.Equal(ErrNotFound, ti.StopTimer(ctx, "0"))
+	a.NoError(ti.ExtendTimer(ctx, "1", 2*time.Hour))
+
+	early, err := ti.rdb.ZScore(ctx, ti.keys.zDeadlines(), "early").Result()
+	a.NoError(err)
+	batch, err := ti.rdb.ZScore(ctx, ti.keys.zDeadlines(), "2").Result()
+	a.NoError(err)
+	a.True(early < batch)
+	next, err := ti.NextDue(ctx, 2)
+	a.NoError(err)
+	a.Len(next, 2)
+	a.Equal("early", next[0])
+	now := time.Now()
+	n, err := ti.CountDue(ctx, time.Time{}, now.Add(time.Second))
+	a.NoError(err)
+	a.Equal(int64(claimBatch+4), n)
+	n, err = ti.CountDue(ctx, now.Add(time.Minute), now.Add(3*time.Hour))
+	a.NoError(err)
+	a.Equal(int64(2), n)
+	a.Equal(int64(claimBatch+6), ti.Stats().Outstanding)
+
+	// everything due is claimed in batches, each timer once
+	go ti.TickProcess(ctx)
+	a.True(f.waitFired(claimBatch+4, 5*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	handles, calls := f.count()
+	a.Equal(claimBatch+4, handles)
+	a.Equal(claimBatch+4, calls)
+	a.Equal(int64(2), ti.Stats().Outstanding)
+	_, err = ti.GetTimer(ctx, "2")
+	a.Equal(ErrAlreadyExpired, err)
+	info, err := ti.GetTimer(ctx, "1")
+	a.NoError(err)
+	a.True(info.Remaining > time.Hour)
+}
+
+func TestRedisZMigrate(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx := context.Background()
+	old := newTimerRedis(timerConfig{}, rc)
+	a.NoError(old.StartTimer(ctx, "a", time.Minute, msgMeta{QURL: "qa"}))
+	a.NoError(old.StartTimer(ctx, "b", time.Hour, msgMeta{QURL: "qb"}))
+	old.CloseTimer()
+
+	ti := newTimerRedisZ(timerConfig{}, rc)
+	defer ti.CloseTimer()
+	a.Equal(int64(2), ti.Stats().Outstanding)
+	info, err := ti.GetTimer(ctx, "a")
+	a.NoError(err)
+	a.Equal("qa", info.Metadata.QURL)
+	next, err := ti.NextDue(ctx, 5)
+	a.NoError(err)
+	a.Equal([]string{"a", "b"}, next)
+	// nothing of the old layout is left
+	keys, err := ti.rdb.Keys(ctx, string(ti.keys)+"*").Result()
+	a.NoError(err)
+	a.ElementsMatch([]string{ti.keys.zTimers(), ti.keys.zDeadlines()}, keys)
+
+	// running it again finds nothing
+	n, err := ti.migrate(ctx)
+	a.NoError(err)
+	a.Equal(0, n)
+}
+
+// the timers of the versions without prefix move under it into either
+// layout, with deadlines in seconds converted to milliseconds
+func TestRedisLegacy(t *testing.T) {
+	for _, layout := range []string{"slots", "zset"} {
+		t.Run(layout, func(t *testing.T) {
+			a := assert.New(t)
+			rc := redisTest(t)
+			ctx := context.Background()
+			var ti timert
+			var migrate func() (int, error)
+			if layout == "slots" {
+				tr := newTimerRedis(timerConfig{}, rc)
+				ti, migrate = tr, func() (int, error) { return tr.migrateLegacy(ctx, tr.legacyCall) }
+			} else {
+				tz := newTimerRedisZ(timerConfig{}, rc)
+				ti, migrate = tz, func() (int, error) { return tz.migrateLegacy(ctx, tz.legacyCall) }
+			}
+			defer ti.CloseTimer()
+			rdb := rc.client()
+			defer rdb.Close()
+			// the legacy keys have no prefix, the handles are unique to the test
+			id := strconv.FormatInt(time.Now().UnixNano(), 36)
+			sec, ms, stopped := "legacy-s-"+id, "legacy-ms-"+id, "legacy-stopped-"+id
+			now := time.Now()
+			secSlot := strconv.FormatInt(now.Unix()+3600, 10)
+			msSlot := strconv.FormatInt(toMillis(now)+7200000, 10)
+			a.NoError(rdb.Set(ctx, sec, fmt.Sprintf(`{"QURL":"qs","Timeout":%s}`, secSlot), 0).Err())
+			a.NoError(rdb.Set(ctx, ms, fmt.Sprintf(`{"QURL":"qm","Timeout":%s}`, msSlot), 0).Err())
+			a.NoError(rdb.SAdd(ctx, secSlot, sec, stopped).Err())
+			a.NoError(rdb.SAdd(ctx, msSlot, ms).Err())
+			defer rdb.Del(ctx, sec, ms, secSlot, msSlot)
+
+			n, err := migrate()
+			a.NoError(err)
+			a.Equal(2, n)
+			info, err := ti.GetTimer(ctx, sec)
+			a.NoError(err)
+			a.Equal("qs", info.Metadata.QURL)
+			a.InDelta(float64(time.Hour), float64(info.Remaining), float64(2*time.Second))
+			info, err = ti.GetTimer(ctx, ms)
+			a.NoError(err)
+			a.Equal("qm", info.Metadata.QURL)
+			a.InDelta(float64(2*time.Hour), float64(info.Remaining), float64(2*time.Second))
+			a.Equal(int64(2), ti.Stats().Outstanding)
+			a.Equal(int64(0), rdb.Exists(ctx, sec, ms, secSlot, msSlot).Val())
+			// the stop script finds them where the layout keeps its timers
+			a.NoError(ti.StopTimer(ctx, sec))
+			a.NoError(ti.StopTimer(ctx, ms))
+			a.Equal(int64(0), ti.Stats().Outstanding)
+		})
+	}
+}
+
+// a timer claimed by a process which died before its handler returned
+// fires again once its lease ran out, a handled one is released
+func TestRedisClaimLease(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &firedCounter{}
+	ti := newTimerRedis(timerConfig{Tick: 20 * time.Millisecond, Handler: f}, rc)
+	defer ti.CloseTimer()
+	a.NoError(ti.rdb.HSet(ctx, ti.keys.claimedTimers(), "lost", `{"QURL":"q","Timeout":1}`).Err())
+	a.NoError(ti.rdb.ZAdd(ctx, ti.keys.claimed(), &redis.Z{Score: float64(toMillis(time.Now()) - 1), Member: "lost"}).Err())
+	a.NoError(ti.rdb.ZAdd(ctx, ti.keys.claimed(), &redis.Z{Score: float64(toMillis(time.Now().Add(time.Hour))), Member: "running"}).Err())
+	a.NoError(ti.rdb.HSet(ctx, ti.keys.claimedTimers(), "running", `{"Timeout":1}`).Err())
+	a.NoError(ti.StartTimer(ctx, "a", 30*time.Millisecond, msgMeta{}))
+
+	go ti.TickProcess(ctx)
+	a.True(f.waitFired(2, 2*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	handles, calls := f.count()
+	a.Equal(2, handles)
+	a.Equal(2, calls)
+	// only the claim whose lease didn't run out is left
+	members, err := ti.rdb.ZRange(ctx, ti.keys.claimed(), 0, -1).Result()
+	a.NoError(err)
+	a.Equal([]string{"running"}, members)
+	fields, err := ti.rdb.HKeys(ctx, ti.keys.claimedTimers()).Result()
+	a.NoError(err)
+	a.Equal([]string{"running"}, fields)
+}
+
+func TestRedisResume(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx := context.Background()
+	cfg := timerConfig{Tick: 20 * time.Millisecond}
+	t1 := newTimerRedis(cfg, rc)
+	a.NoError(t1.StartTimer(ctx, "a", 150*time.Millisecond, msgMeta{}))
+	a.NoError(t1.StartTimer(ctx, "b", time.Hour, msgMeta{}))
+	run, stop := context.WithCancel(ctx)
+	go t1.TickProcess(run)
+	time.Sleep(60 * time.Millisecond)
+	stop()
+	progress, err := t1.rdb.Get(ctx, rc.keys().progress()).Int64()
+	a.NoError(err)
+	t1.CloseTimer()
+
+	// a comes due while no process runs, the next one resumes from the
+	// checkpoint and fires it
+	time.Sleep(200 * time.Millisecond)
+	f := &firedCounter{}
+	cfg.Handler = f
+	t2 := newTimerRedis(cfg, rc)
+	defer t2.CloseTimer()
+	run, stop = context.WithCancel(ctx)
+	defer stop()
+	go t2.TickProcess(run)
+	a.True(f.waitFired(1, time.Second))
+	time.Sleep(50 * time.Millisecond)
+	handles, calls := f.count()
+	a.Equal(1, handles)
+	a.Equal(1, calls)
+	a.Equal(int64(1), t2.Stats().Outstanding)
+	resumed, err := t2.rdb.Get(ctx, rc.keys().progress()).Int64()
+	a.NoError(err)
+	a.True(resumed > progress)
+}
+
+func TestRedisFailedSlot(t *testing.T) {
+	a := assert.New(t)
+	rc := redisTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &firedCounter{}
+	ti := newTimerRedis(timerConfig{Tick: 20 * time.Millisecond, Handler: f}, rc)
+	defer ti.CloseTimer()
+	a.NoError(ti.StartTimer(ctx, "a", 200*time.Millisecond, msgMeta{}))
+	info, err := ti.GetTimer(ctx, "a")
+	a.NoError(err)
+	// the slot before a's can't be claimed, SPOP fails on a string
+	slot := tickSlot(toMillis(info.Deadline), ti.tick)
+	bad := ti.slotKey(slot - 1)
+	a.NoError(ti.rdb.Set(ctx, bad, "x", 0).Err())
+	go ti.TickProcess(ctx)
+	time.Sleep(400 * time.Millisecond)
+	handles, _ := f.count()
+	a.Equal(0, handles)
+	progress, err := ti.rdb.Get(ctx, ti.keys.progress()).Int64()
+	a.NoError(err)
+	a.True(progress < (slot-1)*int64(ti.tick/time.Millisecond))
+
+	// once the slot works again the ticks go on from there
+	a.NoError(ti.rdb.Del(ctx, bad).Err())
+	a.True(f.waitFired(1, time.Second))
 }
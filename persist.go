@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PersistenceSink stores the events of the timerwheel, so InitTimer can
+// rebuild the timers of a previous run
+type PersistenceSink interface {
+	// Append stores events as one batch, the returned future reports when
+	// they are stored. The timerwheel calls it with its lock held, so it
+	// only queues the events, and they are stored in the order of the calls.
+	Append(events ...persistEvent) ackFuture
+	// Replay hands the stored events to fn in the order they were appended
+	// for each timer, fn may be called from several goroutines. It's called
+	// once by InitTimer before the first Append. With from it starts at
+	// those offsets, which came from Offsets, instead of the beginning.
+	Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error
+	// Offsets is the current end of the log for each partition, every event
+	// appended before the call is before them
+	Offsets(ctx context.Context) (map[int]int64, error)
+	Close() error
+}
+
+// ackFuture delivers the result of an Append or an async timer call once,
+// then it's closed
+type ackFuture <-chan error
+
+// Wait returns the result, or the error of ctx when it's done first
+func (f ackFuture) Wait(ctx context.Context) error {
+	select {
+	case err := <-f:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newAck returns a future and the function completing it
+func newAck() (ackFuture, func(error)) {
+	c := make(chan error, 1)
+	return c, func(err error) {
+		c <- err
+		close(c)
+	}
+}
+
+// doneAck is a future which is done already
+func doneAck(err error) ackFuture {
+	ack, done := newAck()
+	done(err)
+	return ack
+}
+
+// nopSink keeps nothing, it's the default when timerConfig.Persistence is
+// nil and timers don't survive a restart
+type nopSink struct{}
+
+func (nopSink) Append(events ...persistEvent) ackFuture { return doneAck(nil) }
+
+func (nopSink) Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error {
+	return nil
+}
+
+func (nopSink) Offsets(ctx context.Context) (map[int]int64, error) { return nil, nil }
+
+func (nopSink) Close() error { return nil }
+
+// fileSink is an append-only log of json events, one per line. Appends
+// only add to pending, the ones queued up while a round is syncing share
+// the next write and fsync.
+type fileSink struct {
+	path string
+	f    *os.File
+	wake chan struct{} // has a value when there's something pending
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+	err  error // of closing f
+
+	lock    sync.Mutex
+	pending []fileAppend
+	closed  bool
+	end     int64 // of the last complete round, see Offsets
+}
+
+type fileAppend struct {
+	events []persistEvent
+	ack    func(error)
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &fileSink{
+		path: path,
+		f:    f,
+		end:  fi.Size(),
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.write()
+	return s, nil
+}
+
+// Append doesn't block, the events are written in the order of the calls
+func (s *fileSink) Append(events ...persistEvent) ackFuture {
+	ack, done := newAck()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		done(ErrClosed)
+		return ack
+	}
+	s.pending = append(s.pending, fileAppend{events, done})
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return ack
+}
+
+// write collects the appends queued up while the previous round was
+// syncing, and writes them in one go
+func (s *fileSink) write() {
+	defer close(s.done)
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+		s.lock.Lock()
+		round := s.pending
+		s.pending = nil
+		s.lock.Unlock()
+		if len(round) == 0 {
+			continue
+		}
+		var size int64
+		fi, err := s.f.Stat()
+		if err == nil {
+			size = fi.Size()
+		}
+		for _, a := range round {
+			for _, ev := range a.events {
+				if err == nil {
+					err = enc.Encode(ev)
+				}
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = s.f.Sync()
+		}
+		if err == nil {
+			// only this goroutine writes, the size is where the round ended
+			if end, err := s.f.Stat(); err == nil {
+				s.setEnd(end.Size())
+			}
+		} else {
+			fmt.Printf("file sink %s: %v\n", s.path, err)
+			// don't leave half a round behind for the next one
+			w.Reset(s.f)
+			if fi != nil {
+				s.f.Truncate(size)
+			}
+		}
+		for _, a := range round {
+			a.ack(err)
+		}
+	}
+}
+
+// Replay reads the log from the start or from the byte offset in from[0].
+// A torn last line from a crash in the middle of a write is cut off.
+func (s *fileSink) Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset := from[0]
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Printf("file sink %s: dropping torn event at offset %d\n", s.path, offset)
+				if err := s.f.Truncate(offset); err != nil {
+					return err
+				}
+				s.setEnd(offset)
+				return nil
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var ev persistEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return fmt.Errorf("%s offset %d: %w", s.path, offset, err)
+		}
+		fn(ev)
+		offset += int64(len(line))
+	}
+}
+
+// Offsets is the end of the last round which was written and synced
+// completely. Appends which aren't done yet end up behind it, a round in
+// progress or one which failed and is cut off again never moves it.
+func (s *fileSink) Offsets(ctx context.Context) (map[int]int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return map[int]int64{0: s.end}, nil
+}
+
+func (s *fileSink) setEnd(end int64) {
+	s.lock.Lock()
+	s.end = end
+	s.lock.Unlock()
+}
+
+// Close waits for the round in progress, the appends still pending fail
+// with ErrClosed
+func (s *fileSink) Close() error {
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.closed = true
+		pending := s.pending
+		s.pending = nil
+		s.lock.Unlock()
+		close(s.quit)
+		<-s.done
+		for _, a := range pending {
+			a.ack(ErrClosed)
+		}
+		s.err = s.f.Close()
+	})
+	return s.err
+}
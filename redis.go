@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// redisLayout is how a Redis timer stores its timers, timerRedis keeps a set
+// per slot and timerRedisZ a sorted set. redisBase does the rest with it.
+type redisLayout interface {
+	// startCall adds the timer unless it's running already, it replies 1
+	// when it did
+	startCall(receiptHandle, value string, deadline int64) redisCall
+	// stopCall removes a running timer, it replies 1 when it did
+	stopCall(receiptHandle string) redisCall
+	// get reads the value of a running timer, redis.Nil when there's none
+	get(ctx context.Context, receiptHandle string) (string, error)
+	// update replaces a running timer with what fn returns for it, unless fn
+	// returns false. It's ErrNotFound when the timer isn't running.
+	update(ctx context.Context, receiptHandle string, fn func(msgMeta) (msgMeta, bool, error)) error
+}
+
+// redisCall is one call of a script
+type redisCall struct {
+	script *redis.Script
+	keys   []string
+	args   []interface{}
+}
+
+func (c redisCall) run(ctx context.Context, rdb *redis.Client) *redis.Cmd {
+	return c.script.Run(ctx, rdb, c.keys, c.args...)
+}
+
+// redisBase is what both Redis timers share, the calls of the API go
+// through the scripts of layout
+type redisBase struct {
+	rdb      *redis.Client
+	keys     redisKeys       // all keys are under this prefix
+	ctx      context.Context // only used by PrintTimer and Stats
+	counters timerCounters   // of this process
+	layout   redisLayout
+
+	handler ExpiryHandler // called for each expired timer
+	tick    time.Duration // how often TickProcess runs, also the width of a timerRedis slot
+	dup     dupPolicy     // what StartTimer does for a running timer
+	async   *asyncQueue   // runs StartTimerAsync/StopTimerAsync as pipelines
+
+	catchUp catchUpConfig // what TickProcess does with the overdue timers
+	initAt  time.Time     // timers due before it are caught up on
+}
+
+// newRedisBase connects to the db of rc, the caller sets layout and async.
+// The error is from the first ping, it's printed already.
+func newRedisBase(cfg timerConfig, rc redisConfig) (*redisBase, error) {
+	t := &redisBase{
+		rdb:     rc.client(),
+		keys:    rc.keys(),
+		ctx:     context.Background(),
+		tick:    cfg.tick(),
+		dup:     cfg.Duplicate,
+		catchUp: cfg.CatchUp,
+		initAt:  time.Now()}
+	t.handler = cfg.expiryHandler(&t.counters)
+	err := t.rdb.Ping(t.ctx).Err()
+	if err != nil {
+		fmt.Printf("can't connect to redis: %v\n", err)
+	}
+	return t, err
+}
+
+func (t *redisBase) StartTimer(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) error {
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	metadata.Timeout = toMillis(time.Now().Add(timeout))
+	return t.start(ctx, receiptHandle, metadata)
+}
+
+func (t *redisBase) start(ctx context.Context, receiptHandle string, metadata msgMeta) error {
+	// use JSON string for any metadata saved together with each timer
+	j, err := json.Marshal(metadata)
+	if err != nil {
+		fmt.Printf("Failed to encoding to JSON\n")
+		return err
+	}
+	// the running timer could be gone before it is replaced, then try again
+	for i := 0; i < 10; i++ {
+		var r int
+		r, err = t.layout.startCall(receiptHandle, string(j), metadata.Timeout).run(ctx, t.rdb).Int()
+		if err != nil {
+			break
+		}
+		if r == 1 {
+			t.counters.countCreated(1)
+			return nil
+		}
+		if t.dup == DupReject {
+			return ErrAlreadyExists
+		}
+		err = t.layout.update(ctx, receiptHandle, func(old msgMeta) (msgMeta, bool, error) {
+			replace, err := t.dup.replaces(old.Timeout, metadata.Timeout)
+			return metadata, replace, err
+		})
+		if err != ErrNotFound {
+			break
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		if err = redisError(err); err != ErrClosed {
+			fmt.Printf("Failed to update database in start timer: %v\n", err)
+		}
+	}
+
+	return err
+}
+
+func (t *redisBase) StopTimer(ctx context.Context, receiptHandle string) error {
+	r, err := t.layout.stopCall(receiptHandle).run(ctx, t.rdb).Int64()
+	return t.stopped(ctx, receiptHandle, r, err)
+}
+
+// stopped does the bookkeeping for a stop script which removed r timers
+func (t *redisBase) stopped(ctx context.Context, receiptHandle string, r int64, err error) error {
+	if err != nil {
+		if err = redisError(err); err != ErrClosed {
+			fmt.Printf("Failed to update database in stop timer: %v\n", err)
+		}
+	} else if r == 0 {
+		// These are timer already expired hence does not exist in Redis DB anymore
+		if err = t.missing(ctx, receiptHandle); err == ErrAlreadyExpired {
+			t.counters.countStopAfterExpiry(1)
+		}
+	} else {
+		t.counters.countStopped(1)
+	}
+
+	return err
+}
+
+// pipeline runs the calls in one pipeline, nil ones are left out. EVALSHA
+// can't fall back to EVAL inside a pipeline, so the scripts are loaded first.
+func (t *redisBase) pipeline(ctx context.Context, calls []*redisCall) ([]*redis.Cmd, error) {
+	loaded := make(map[*redis.Script]bool)
+	cmds := make([]*redis.Cmd, len(calls))
+	pipe := t.rdb.Pipeline()
+	for i, c := range calls {
+		if c == nil {
+			continue
+		}
+		if !loaded[c.script] {
+			if err := c.script.Load(ctx, t.rdb).Err(); err != nil {
+				return nil, redisError(err)
+			}
+			loaded[c.script] = true
+		}
+		cmds[i] = c.script.EvalSha(ctx, pipe, c.keys, c.args...)
+	}
+	// the result of each command is checked by the caller
+	pipe.Exec(ctx)
+	return cmds, nil
+}
+
+// StartTimers sends the whole batch in one pipeline. Only timers which are
+// running already need more round trips, when the policy may replace them.
+func (t *redisBase) StartTimers(ctx context.Context, timers []timerRequest) []error {
+	now := time.Now()
+	errs := make([]error, len(timers))
+	calls := make([]*redisCall, len(timers))
+	for i := range timers {
+		r := &timers[i]
+		if errs[i] = checkTimeout(r.Timeout); errs[i] != nil {
+			continue
+		}
+		metadata := r.Metadata
+		metadata.Timeout = toMillis(now.Add(r.Timeout))
+		j, err := json.Marshal(metadata)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		c := t.layout.startCall(r.ReceiptHandle, string(j), metadata.Timeout)
+		calls[i] = &c
+	}
+	cmds, err := t.pipeline(ctx, calls)
+	if err != nil {
+		return batchErrors(len(timers), err)
+	}
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		r, err := cmd.Int()
+		switch {
+		case err != nil:
+			errs[i] = redisError(err)
+		case r == 1:
+			t.counters.countCreated(1)
+		case t.dup == DupReject:
+			errs[i] = ErrAlreadyExists
+		default:
+			metadata := timers[i].Metadata
+			metadata.Timeout = toMillis(now.Add(timers[i].Timeout))
+			errs[i] = t.start(ctx, timers[i].ReceiptHandle, metadata)
+		}
+	}
+	return errs
+}
+
+func (t *redisBase) StopTimers(ctx context.Context, receiptHandles []string) []error {
+	calls := make([]*redisCall, len(receiptHandles))
+	for i, h := range receiptHandles {
+		c := t.layout.stopCall(h)
+		calls[i] = &c
+	}
+	cmds, err := t.pipeline(ctx, calls)
+	if err != nil {
+		return batchErrors(len(receiptHandles), err)
+	}
+	errs := make([]error, len(receiptHandles))
+	for i, cmd := range cmds {
+		r, err := cmd.Int64()
+		errs[i] = t.stopped(ctx, receiptHandles[i], r, err)
+	}
+	return errs
+}
+
+// StartTimerAsync queues the timer for the next StartTimers round
+func (t *redisBase) StartTimerAsync(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) ackFuture {
+	return t.async.start(ctx, timerRequest{receiptHandle, timeout, metadata})
+}
+
+func (t *redisBase) StopTimerAsync(ctx context.Context, receiptHandle string) ackFuture {
+	return t.async.stop(ctx, receiptHandle)
+}
+
+func (t *redisBase) ExtendTimer(ctx context.Context, receiptHandle string, timeout time.Duration) error {
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	deadline := toMillis(time.Now().Add(timeout))
+	err := t.layout.update(ctx, receiptHandle, func(metadata msgMeta) (msgMeta, bool, error) {
+		metadata.Timeout = deadline
+		return metadata, true, nil
+	})
+	if err == ErrNotFound {
+		return t.missing(ctx, receiptHandle)
+	} else if err != nil {
+		if err = redisError(err); err != ErrClosed {
+			fmt.Printf("Failed to update database in extend timer: %v\n", err)
+		}
+	}
+
+	return err
+}
+
+func (t *redisBase) GetTimer(ctx context.Context, receiptHandle string) (timerInfo, error) {
+	v, err := t.layout.get(ctx, receiptHandle)
+	if err == redis.Nil {
+		return timerInfo{}, t.missing(ctx, receiptHandle)
+	} else if err != nil {
+		return timerInfo{}, redisError(err)
+	}
+	var metadata msgMeta
+	if err = json.Unmarshal([]byte(v), &metadata); err != nil {
+		return timerInfo{}, err
+	}
+	return newTimerInfo(metadata), nil
+}
+
+// missing tells ErrAlreadyExpired from ErrNotFound by the marker TickProcess
+// leaves for an expired timer
+func (t *redisBase) missing(ctx context.Context, receiptHandle string) error {
+	n, err := t.rdb.Exists(ctx, t.keys.expired(receiptHandle)).Result()
+	if err != nil {
+		return redisError(err)
+	}
+	if n > 0 {
+		return ErrAlreadyExpired
+	}
+	return ErrNotFound
+}
+
+// legacyMove is the call moving a timer of the layout without prefix, from
+// the set slot and the key receiptHandle, if that still has the value old.
+// The new value has the deadline in milliseconds.
+type legacyMove func(slot, receiptHandle, old, value string, deadline int64) redisCall
+
+// migrateLegacy moves the timers an earlier version kept without a key
+// prefix into the layout with move and returns how many there were. They
+// are in a set per slot named by the bare Unix second of the slot, later the
+// millisecond, and the receiptHandle itself is the key of the metadata.
+// Deadlines in seconds are converted. The processes of the earlier version
+// have to be stopped, it's safe to run again after a failure.
+func (t *redisBase) migrateLegacy(ctx context.Context, move legacyMove) (int, error) {
+	var slots []string
+	var cur uint64
+	for {
+		batch, next, err := t.rdb.Scan(ctx, cur, "[0-9]*", 1000).Result()
+		if err != nil {
+			return 0, redisError(err)
+		}
+		for _, k := range batch {
+			if _, err := strconv.ParseInt(k, 10, 64); err == nil {
+				slots = append(slots, k)
+			}
+		}
+		if cur = next; cur == 0 {
+			break
+		}
+	}
+	var n int
+	for _, slot := range slots {
+		if typ, err := t.rdb.Type(ctx, slot).Result(); err != nil {
+			return n, redisError(err)
+		} else if typ != "set" {
+			continue
+		}
+		handles, err := t.rdb.SMembers(ctx, slot).Result()
+		if err != nil {
+			return n, redisError(err)
+		}
+		for _, h := range handles {
+			// the earlier version left the handle of a stopped timer in its
+			// set, the script only removes it then
+			old, err := t.rdb.Get(ctx, h).Result()
+			if err != nil && err != redis.Nil {
+				return n, redisError(err)
+			}
+			var metadata msgMeta
+			var value []byte
+			if old != "" {
+				if err := json.Unmarshal([]byte(old), &metadata); err != nil {
+					return n, fmt.Errorf("%s: %w", h, err)
+				}
+				metadata.Timeout = fromSecondsTimeout(metadata.Timeout)
+				if value, err = json.Marshal(metadata); err != nil {
+					return n, err
+				}
+			}
+			r, err := move(slot, h, old, string(value), metadata.Timeout).run(ctx, t.rdb).Int()
+			if err != nil {
+				return n, redisError(err)
+			}
+			n += r
+		}
+	}
+	return n, redisError(t.rdb.Del(ctx, "progress").Err())
+}
+
+// how long the handler of a claimed timer may take, after that the timer is
+// taken to be lost with its process and fired again
+const claimLease = time.Minute
+
+// reclaimScript renews the lease of up to ARGV[2] timers in the claimed set
+// KEYS[2] whose lease ran out by ARGV[1] to ARGV[3], it returns their number
+// and the handle and value in KEYS[1] of each like the claim scripts
+var reclaimScript = redis.NewScript(`
+local hs = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local out = {#hs}
+for _, h in ipairs(hs) do
+	local v = redis.call('HGET', KEYS[1], h)
+	if v then
+		redis.call('ZADD', KEYS[2], ARGV[3], h)
+		table.insert(out, h)
+		table.insert(out, v)
+	else
+		redis.call('ZREM', KEYS[2], h)
+	end
+end
+return out
+`)
+
+// handOver hands the timers in the reply v of a claim script to fn and
+// releases their claims once it returned for all of them, it returns how
+// many the script took out of the index
+func (t *redisBase) handOver(ctx context.Context, v interface{}, fn func(string, msgMeta)) (int64, error) {
+	res, ok := v.([]interface{})
+	if !ok || len(res) == 0 {
+		return 0, fmt.Errorf("unexpected claim reply %v", v)
+	}
+	taken, _ := res[0].(int64)
+	var handles []string
+	for i := 1; i+1 < len(res); i += 2 {
+		h, _ := res[i].(string)
+		v, _ := res[i+1].(string)
+		var metadata msgMeta
+		if err := json.Unmarshal([]byte(v), &metadata); err != nil {
+			fmt.Printf("json decoding failed: %v\n", err)
+		}
+		fn(h, metadata)
+		handles = append(handles, h)
+	}
+	if len(handles) > 0 {
+		// a claim which isn't released fires again after its lease
+		members := make([]interface{}, len(handles))
+		for i, h := range handles {
+			members[i] = h
+		}
+		pipe := t.rdb.Pipeline()
+		pipe.ZRem(ctx, t.keys.claimed(), members...)
+		pipe.HDel(ctx, t.keys.claimedTimers(), handles...)
+		if _, err := pipe.Exec(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to release %d claimed timers: %v\n", len(handles), err)
+		}
+	}
+	return taken, nil
+}
+
+// fire hands an expired timer to the handler
+func (t *redisBase) fire(receiptHandle string, metadata msgMeta) {
+	t.counters.countExpired(1)
+	t.handler.TimerExpired(receiptHandle, metadata)
+}
+
+// reclaim hands the claimed timers whose lease ran out to fn again, their
+// process is taken to have died before their handler returned. A timer
+// claimed by CatchUpDrop is fired then too.
+func (t *redisBase) reclaim(ctx context.Context, fn func(string, msgMeta)) error {
+	for {
+		now := time.Now()
+		v, err := reclaimScript.Run(ctx, t.rdb, []string{t.keys.claimedTimers(), t.keys.claimed()},
+			toMillis(now), claimBatch, toMillis(now.Add(claimLease))).Result()
+		var taken int64
+		if err == nil {
+			taken, err = t.handOver(ctx, v, fn)
+		}
+		if err != nil {
+			if err = redisError(err); err != ErrClosed && ctx.Err() == nil {
+				fmt.Printf("Failed to reclaim timers, %v\n", err)
+			}
+			return err
+		}
+		if taken < claimBatch {
+			return nil
+		}
+	}
+}
+
+// redisError maps go-redis errors to the ones shared by all implementations
+func redisError(err error) error {
+	if err == redis.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+func (t *redisBase) CloseTimer() {
+	t.async.close()
+	t.rdb.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// wheelSnapshot is the state of a timerwheel at the sink Offsets, on restart
+// only the events from there on are replayed
+type wheelSnapshot struct {
+	Taken      time.Time
+	Offsets    map[int]int64
+	Resolution time.Duration
+	Cur        int64 // wheel position, only restored for the same Resolution
+	Timers     []startEvent
+}
+
+// SnapshotStore keeps the newest snapshot of a timerwheel
+type SnapshotStore interface {
+	Save(snap *wheelSnapshot) error
+	// Load returns nil without error when there's no snapshot yet
+	Load() (*wheelSnapshot, error)
+}
+
+// fileSnapshots keeps the snapshot in a local file, it's replaced as a whole
+// so a crash while saving leaves the previous one
+type fileSnapshots struct {
+	path string
+}
+
+func newFileSnapshots(path string) *fileSnapshots {
+	return &fileSnapshots{path}
+}
+
+func (s *fileSnapshots) Save(snap *wheelSnapshot) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("snapshot %s: %w", s.path, err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileSnapshots) Load() (*wheelSnapshot, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := &wheelSnapshot{}
+	if err := json.NewDecoder(f).Decode(snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", s.path, err)
+	}
+	return snap, nil
+}
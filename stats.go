@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// timerStats is returned by Stats, every implementation fills in the same
+// fields
+type timerStats struct {
+	Created         uint64 // timers started
+	Stopped         uint64 // timers stopped before they expired
+	Expired         uint64 // timers expired and handed to the ExpiryHandler
+	StopAfterExpiry uint64 // StopTimer calls for timers which were not running anymore
+	Dropped         uint64 // overdue timers dropped by CatchUpDrop
+	Undelivered     uint64 // expired messages the QueueSink failed to take
+	Outstanding     int64  // timers currently running
+
+	Ticks   uint64 // number of tick processing rounds measured
+	TickP50 time.Duration
+	TickP90 time.Duration
+	TickP99 time.Duration
+	TickMax time.Duration
+}
+
+func printStats(s timerStats) {
+	fmt.Printf("Total created: %v, expired: %v, canceled: %v, stop after expiry: %v, dropped: %v, undelivered: %v, outstanding: %v\n",
+		s.Created, s.Expired, s.Stopped, s.StopAfterExpiry, s.Dropped, s.Undelivered, s.Outstanding)
+	fmt.Printf("Tick process time (n: %d), p50: %v, p90: %v, p99: %v, max: %v\n",
+		s.Ticks, s.TickP50, s.TickP90, s.TickP99, s.TickMax)
+}
+
+// timerCounters keeps the statistics for an implementation, it has its own
+// lock so it can be updated from any goroutine. A negative n takes back a
+// count of a change which was rolled back.
+type timerCounters struct {
+	lock            sync.Mutex
+	created         uint64
+	stopped         uint64
+	expired         uint64
+	stopAfterExpiry uint64
+	dropped         uint64
+	undelivered     uint64
+	ticks           tickHistogram
+}
+
+func (c *timerCounters) countCreated(n int) {
+	c.lock.Lock()
+	c.created += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) countStopped(n int) {
+	c.lock.Lock()
+	c.stopped += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) countExpired(n int) {
+	c.lock.Lock()
+	c.expired += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) countStopAfterExpiry(n int) {
+	c.lock.Lock()
+	c.stopAfterExpiry += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) countDropped(n int) {
+	c.lock.Lock()
+	c.dropped += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) countUndelivered(n int) {
+	c.lock.Lock()
+	c.undelivered += uint64(n)
+	c.lock.Unlock()
+}
+
+func (c *timerCounters) observeTick(d time.Duration) {
+	c.lock.Lock()
+	c.ticks.observe(d)
+	c.lock.Unlock()
+}
+
+// stats takes a snapshot of the counters, outstanding comes from the
+// implementation since only it knows how many timers it holds
+func (c *timerCounters) stats(outstanding int64) timerStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return timerStats{
+		Created:         c.created,
+		Stopped:         c.stopped,
+		Expired:         c.expired,
+		StopAfterExpiry: c.stopAfterExpiry,
+		Dropped:         c.dropped,
+		Undelivered:     c.undelivered,
+		Outstanding:     outstanding,
+		Ticks:           c.ticks.n,
+		TickP50:         c.ticks.quantile(0.50),
+		TickP90:         c.ticks.quantile(0.90),
+		TickP99:         c.ticks.quantile(0.99),
+		TickMax:         c.ticks.max,
+	}
+}
+
+// tickHistogram records durations in log-linear buckets: values below 16ns
+// get their own bucket, above that every power of two is split into 8
+// buckets. Memory is fixed and quantiles are within 12.5% of the real value.
+const histBuckets = 16 + 60*8
+
+type tickHistogram struct {
+	counts [histBuckets]uint64
+	n      uint64
+	max    time.Duration
+}
+
+func histBucket(v uint64) int {
+	if v < 16 {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1
+	return 16 + (exp-4)*8 + int((v>>(exp-3))&7)
+}
+
+// histUpper is the largest value falling into bucket i
+func histUpper(i int) uint64 {
+	if i < 16 {
+		return uint64(i)
+	}
+	exp := uint((i-16)/8 + 4)
+	m := uint64((i - 16) % 8)
+	return (8+m+1)<<(exp-3) - 1
+}
+
+func (h *tickHistogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histBucket(uint64(d))]++
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *tickHistogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.n) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if v := time.Duration(histUpper(i)); v < h.max {
+				return v
+			}
+			break
+		}
+	}
+	return h.max
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -10,7 +11,53 @@ type msgMeta struct {
 	Dlq      string
 	QURL     string
 	Relcount int
-	Timeout  int64
+	Timeout  int64 // deadline in Unix milliseconds
+}
+
+// toMillis converts t to Unix milliseconds as used in msgMeta.Timeout
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// deadlines below it were stored in Unix seconds by the versions before
+// msgMeta.Timeout was in milliseconds, 1e11 seconds are in the year 5138
+// while 1e11 ms were in 1973
+const secondsTimeoutLimit = 1e11
+
+// fromSecondsTimeout converts a deadline stored in Unix seconds by an
+// earlier version to milliseconds, one in milliseconds is kept
+func fromSecondsTimeout(timeout int64) int64 {
+	if timeout < secondsTimeoutLimit {
+		return timeout * 1000
+	}
+	return timeout
+}
+
+// tickSlot returns the number of the tick in which a deadline (in Unix
+// milliseconds) is due. It rounds up so timers never fire early.
+func tickSlot(ms int64, tick time.Duration) int64 {
+	tms := int64(tick / time.Millisecond)
+	return (ms + tms - 1) / tms
+}
+
+// timerInfo is what GetTimer reports about a running timer
+type timerInfo struct {
+	Metadata  msgMeta
+	Deadline  time.Time
+	Remaining time.Duration // zero once the deadline has passed
+}
+
+func newTimerInfo(metadata msgMeta) timerInfo {
+	deadline := fromMillis(metadata.Timeout)
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return timerInfo{metadata, deadline, remaining}
 }
 
 type void struct{}
@@ -23,114 +70,269 @@ type timer struct {
 	msgQueue  map[string]msgMeta
 	timeQueue map[int64]handleList
 	lock      sync.Mutex
-	total     int
-	delC      int
-	expC      int
-	avg       time.Duration
+	counters  timerCounters
+	expired   recentExpiry
+	handler   ExpiryHandler
+	tick      time.Duration
+	dup       dupPolicy
+	closed    bool
 }
 
-func (t *timer) InitTimer() timert {
-	t = &timer{}
+func (t *timer) InitTimer(cfg timerConfig) timert {
+	t = &timer{tick: cfg.tick(), dup: cfg.Duplicate}
+	t.handler = cfg.expiryHandler(&t.counters)
 	t.msgQueue = make(map[string]msgMeta)
 	t.timeQueue = make(map[int64]handleList)
-	t.total = 0
-	t.delC = 0
-	t.expC = 0
-	t.avg = 0
 
 	return t
 }
 
-func (t *timer) StartTimer(receiptHandle string, timeout int, metadata msgMeta) error {
-	now := time.Now().Unix()
-	setT := now + int64(timeout)
-	metadata.Timeout = setT
+func (t *timer) StartTimer(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	metadata.Timeout = toMillis(time.Now().Add(timeout))
 	t.lock.Lock()
-	t.msgQueue[receiptHandle] = metadata
-	h, ok := t.timeQueue[setT]
-	if ok {
-		h[receiptHandle] = void{}
-	} else {
-		h = make(map[string]void)
-		h[receiptHandle] = void{}
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrClosed
 	}
-	t.timeQueue[setT] = h
-	t.total++
-	t.lock.Unlock()
+	return t.start(receiptHandle, metadata)
+}
 
-	// fmt.Printf("Add timer: %v at %v(%v)\n", receiptHandle, timeout, setT)
+// start and stop do the work for both single and batch calls, lock must be
+// held
+func (t *timer) start(receiptHandle string, metadata msgMeta) error {
+	if m, ok := t.msgQueue[receiptHandle]; ok {
+		replace, err := t.dup.replaces(m.Timeout, metadata.Timeout)
+		if replace {
+			t.removeSlot(receiptHandle, m.Timeout)
+			t.msgQueue[receiptHandle] = metadata
+			t.addSlot(receiptHandle, metadata.Timeout)
+		}
+		return err
+	}
+	t.msgQueue[receiptHandle] = metadata
+	t.addSlot(receiptHandle, metadata.Timeout)
+	t.expired.forget(receiptHandle)
+	t.counters.countCreated(1)
+
+	// fmt.Printf("Add timer: %v at %v\n", receiptHandle, metadata.Timeout)
 	return nil
 }
 
-func (t *timer) StopTimer(receiptHandle string) error {
+func (t *timer) StopTimer(ctx context.Context, receiptHandle string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	return t.stop(receiptHandle)
+}
+
+func (t *timer) stop(receiptHandle string) error {
 	m, ok := t.msgQueue[receiptHandle]
-	if ok {
-		ti := m.Timeout
-		delete(t.msgQueue, receiptHandle)
-		h, e := t.timeQueue[ti]
-		if e {
-			delete(h, receiptHandle)
+	if !ok {
+		err := t.expired.missing(receiptHandle)
+		if err == ErrAlreadyExpired {
+			t.counters.countStopAfterExpiry(1)
 		}
-		if len(h) == 0 {
-			delete(t.timeQueue, ti)
-		}
-		t.delC++
+		return err
 	}
-	t.lock.Unlock()
+	delete(t.msgQueue, receiptHandle)
+	t.removeSlot(receiptHandle, m.Timeout)
+	t.counters.countStopped(1)
 
 	// fmt.Printf("Stop timer: %v\n", receiptHandle)
 	return nil
 }
 
-func (t *timer) TickProcess() {
-	// run every seconds
-	lastT := time.Now().Unix() - 5
-	var n time.Duration = 0
+func (t *timer) StartTimers(ctx context.Context, timers []timerRequest) []error {
+	if err := ctx.Err(); err != nil {
+		return batchErrors(len(timers), err)
+	}
+	now := time.Now()
+	errs := make([]error, len(timers))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return batchErrors(len(timers), ErrClosed)
+	}
+	for i, r := range timers {
+		if errs[i] = checkTimeout(r.Timeout); errs[i] != nil {
+			continue
+		}
+		r.Metadata.Timeout = toMillis(now.Add(r.Timeout))
+		errs[i] = t.start(r.ReceiptHandle, r.Metadata)
+	}
+	return errs
+}
+
+func (t *timer) StopTimers(ctx context.Context, receiptHandles []string) []error {
+	if err := ctx.Err(); err != nil {
+		return batchErrors(len(receiptHandles), err)
+	}
+	errs := make([]error, len(receiptHandles))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return batchErrors(len(receiptHandles), ErrClosed)
+	}
+	for i, h := range receiptHandles {
+		errs[i] = t.stop(h)
+	}
+	return errs
+}
+
+// StartTimerAsync has nothing to wait for, the map isn't persisted
+func (t *timer) StartTimerAsync(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) ackFuture {
+	return doneAck(t.StartTimer(ctx, receiptHandle, timeout, metadata))
+}
+
+func (t *timer) StopTimerAsync(ctx context.Context, receiptHandle string) ackFuture {
+	return doneAck(t.StopTimer(ctx, receiptHandle))
+}
+
+func (t *timer) ExtendTimer(ctx context.Context, receiptHandle string, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	deadline := toMillis(time.Now().Add(timeout))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	m, ok := t.msgQueue[receiptHandle]
+	if !ok {
+		return t.expired.missing(receiptHandle)
+	}
+	t.removeSlot(receiptHandle, m.Timeout)
+	m.Timeout = deadline
+	t.msgQueue[receiptHandle] = m
+	t.addSlot(receiptHandle, deadline)
+	return nil
+}
+
+func (t *timer) GetTimer(ctx context.Context, receiptHandle string) (timerInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return timerInfo{}, err
+	}
+	t.lock.Lock()
+	m, ok := t.msgQueue[receiptHandle]
+	closed := t.closed
+	t.lock.Unlock()
+	if closed {
+		return timerInfo{}, ErrClosed
+	}
+	if !ok {
+		return timerInfo{}, t.expired.missing(receiptHandle)
+	}
+	return newTimerInfo(m), nil
+}
+
+// addSlot and removeSlot maintain timeQueue, lock must be held
+func (t *timer) addSlot(receiptHandle string, deadline int64) {
+	setT := tickSlot(deadline, t.tick)
+	h, ok := t.timeQueue[setT]
+	if !ok {
+		h = make(map[string]void)
+		t.timeQueue[setT] = h
+	}
+	h[receiptHandle] = void{}
+}
+
+func (t *timer) removeSlot(receiptHandle string, deadline int64) {
+	ti := tickSlot(deadline, t.tick)
+	h, e := t.timeQueue[ti]
+	if e {
+		delete(h, receiptHandle)
+		if len(h) == 0 {
+			delete(t.timeQueue, ti)
+		}
+	}
+}
+
+func (t *timer) TickProcess(ctx context.Context) {
+	// run every tick, slot i holds the timers due at i*tick
+	lastT := toMillis(time.Now().Add(-5*time.Second)) / int64(t.tick/time.Millisecond)
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
 	for {
+		t.lock.Lock()
+		closed := t.closed
+		t.lock.Unlock()
+		if closed {
+			return
+		}
 		st := time.Now()
-		now := time.Now().Unix()
+		now := toMillis(st) / int64(t.tick/time.Millisecond)
 		for i := lastT; i <= now; i++ {
+			var expired map[string]msgMeta
 			t.lock.Lock()
 			h, e := t.timeQueue[i]
 			if e {
+				expired = make(map[string]msgMeta, len(h))
 				for key, _ := range h {
-					m := t.msgQueue[key]
-					if m.Relcount > 0 {
-					}
 					// fmt.Printf("%v timeout at: %v\n", key, now)
-					// check m.relcount
-					// if count > 0, read msg, put it back to original queue
-					// if count == 0, read msg, put it into dlq
+					expired[key] = t.msgQueue[key]
+					t.expired.add(key)
 					delete(t.msgQueue, key)
-					t.expC++
 				}
 				delete(t.timeQueue, i)
 			}
 			t.lock.Unlock()
+			t.counters.countExpired(len(expired))
+			// call the handler without lock, it may start new timers
+			for key, m := range expired {
+				t.handler.TimerExpired(key, m)
+			}
 		}
-		n += 1
-		delta := time.Since(st)
-		t.avg = (delta-t.avg)/n + t.avg
+		t.counters.observeTick(time.Since(st))
 
 		lastT = now + 1
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
+func (t *timer) Stats() timerStats {
+	t.lock.Lock()
+	n := len(t.msgQueue)
+	t.lock.Unlock()
+	return t.counters.stats(int64(n))
+}
+
 func (t *timer) PrintTimer() {
-	fmt.Printf("Current time: %v\n", time.Now().Unix())
+	t.lock.Lock()
+	fmt.Printf("Current time: %v\n", toMillis(time.Now()))
 	for k, v := range t.timeQueue {
-		fmt.Printf("timer: %v", k)
+		fmt.Printf("timer: %v", k*int64(t.tick/time.Millisecond))
 		for h, _ := range v {
 			fmt.Printf(" for handler: %v", h)
 		}
 		fmt.Printf("\n")
 	}
-	fmt.Printf("Total created: %v, expired: %v, canceled: %v\n", t.total, t.expC, t.delC)
-	fmt.Printf("Average tick process time: %v\n", t.avg)
+	t.lock.Unlock()
+	printStats(t.Stats())
 }
 
+// CloseTimer stops TickProcess at its next tick, the timers are all lost
 func (t *timer) CloseTimer() {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,120 +12,530 @@ import (
 // use buntDB for timer
 // with transaction, no lock is needed
 type timerDB struct {
-	db    *buntdb.DB
-	total int
-	delC  int
-	expC  int
-	avg   time.Duration
-}
-
-func (t *timerDB) InitTimer() timert {
-	var err error
-	t = &timerDB{nil, 0, 0, 0, 0}
-	t.db, err = buntdb.Open("data.db")
-	// t.db, err = buntdb.Open(":memory:")
-	t.db.CreateIndex("timer", "*", buntdb.IndexJSON("Timeout"))
+	db       *buntdb.DB
+	counters timerCounters
+	expired  recentExpiry
+	handler  ExpiryHandler
+	tick     time.Duration
+	dup      dupPolicy
+	async    *asyncQueue
+	index    string
+	catchUp  catchUpConfig
+	initAt   time.Time // timers due before it are caught up on
+}
+
+// most timers expired in one transaction, so a long list of overdue timers
+// doesn't hold the db in one giant transaction
+const dbExpiryBatch = 10000
+
+// dbConfig is where and how a timerDB keeps its timers, the zero value is
+// "data.db" with buntdb's defaults
+type dbConfig struct {
+	// Path of the db file or ":memory:"
+	Path string
+	Sync dbSync
+	// AutoShrinkPercentage and AutoShrinkMinSize of the append only file,
+	// 0 keeps buntdb's default (100% and 32MB)
+	AutoShrinkPercentage int
+	AutoShrinkMinSize    int
+	AutoShrinkDisabled   bool
+	// Index on the deadline, "timer" by default
+	Index string
+}
+
+// dbSync is how often buntdb syncs the file
+type dbSync int
+
+const (
+	DBSyncEverySecond dbSync = iota // the default
+	DBSyncAlways                    // sync every transaction, async acks are durable
+	DBSyncNever                     // leave it to the OS
+)
+
+func (s dbSync) policy() buntdb.SyncPolicy {
+	switch s {
+	case DBSyncAlways:
+		return buntdb.Always
+	case DBSyncNever:
+		return buntdb.Never
+	}
+	return buntdb.EverySecond
+}
+
+// InitTimer opens "data.db", use newTimerDB for anything else. When it
+// can't be opened the timer is closed.
+func (t *timerDB) InitTimer(cfg timerConfig) timert {
+	t, err := newTimerDB(cfg, dbConfig{})
 	if err != nil {
 		fmt.Printf("%v\n", err)
+		t = closedTimerDB(cfg)
 	}
+	return t
+}
 
+// closedTimerDB has no db, every call fails with ErrClosed
+func closedTimerDB(cfg timerConfig) *timerDB {
+	t := &timerDB{tick: cfg.tick()}
+	t.handler = cfg.expiryHandler(&t.counters)
+	t.async = newAsyncQueue(t)
+	t.async.close()
 	return t
 }
 
-func (t *timerDB) StartTimer(receiptHandle string, timeout int, metadata msgMeta) error {
-	now := time.Now().Unix()
-	setT := now + int64(timeout)
-	metadata.Timeout = setT
+// update and view run fn in a transaction, a timerDB without a db is closed
+func (t *timerDB) update(fn func(tx *buntdb.Tx) error) error {
+	if t.db == nil {
+		return buntdb.ErrDatabaseClosed
+	}
+	return t.db.Update(fn)
+}
+
+func (t *timerDB) view(fn func(tx *buntdb.Tx) error) error {
+	if t.db == nil {
+		return buntdb.ErrDatabaseClosed
+	}
+	return t.db.View(fn)
+}
 
-	j, err := json.Marshal(metadata)
+// newTimerDB opens the db of dbc, every timerDB needs a file of its own
+func newTimerDB(cfg timerConfig, dbc dbConfig) (*timerDB, error) {
+	path, index := dbc.Path, dbc.Index
+	if path == "" {
+		path = "data.db"
+	}
+	if index == "" {
+		index = "timer"
+	}
+	db, err := buntdb.Open(path)
 	if err != nil {
-		fmt.Printf("Failed to encoding to JSON\n")
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	var c buntdb.Config
+	if err := db.ReadConfig(&c); err != nil {
+		db.Close()
+		return nil, err
+	}
+	c.SyncPolicy = dbc.Sync.policy()
+	if dbc.AutoShrinkPercentage > 0 {
+		c.AutoShrinkPercentage = dbc.AutoShrinkPercentage
+	}
+	if dbc.AutoShrinkMinSize > 0 {
+		c.AutoShrinkMinSize = dbc.AutoShrinkMinSize
+	}
+	c.AutoShrinkDisabled = dbc.AutoShrinkDisabled
+	if err := db.SetConfig(c); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.CreateIndex(index, "*", buntdb.IndexJSON("Timeout")); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create index %s: %w", index, err)
+	}
+	if n, err := convertSecondsTimeouts(db, index); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("convert deadlines in seconds: %w", err)
+	} else if n > 0 {
+		fmt.Printf("Converted %d deadlines from seconds to milliseconds\n", n)
+	}
+	t := &timerDB{
+		db:      db,
+		tick:    cfg.tick(),
+		dup:     cfg.Duplicate,
+		index:   index,
+		catchUp: cfg.CatchUp,
+		initAt:  time.Now(),
+	}
+	t.handler = cfg.expiryHandler(&t.counters)
+	t.async = newAsyncQueue(t)
+	return t, nil
+}
+
+// convertSecondsTimeouts moves the deadlines an earlier version stored in
+// Unix seconds to milliseconds, in one transaction. The index sorts them
+// before all others, so a db without any is done right away.
+func convertSecondsTimeouts(db *buntdb.DB, index string) (int, error) {
+	var n int
+	err := db.Update(func(tx *buntdb.Tx) error {
+		var keys, values []string
+		below := fmt.Sprintf(`{"Timeout":%d}`, int64(secondsTimeoutLimit))
+		err := tx.AscendLessThan(index, below, func(key, value string) bool {
+			keys = append(keys, key)
+			values = append(values, value)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			var metadata msgMeta
+			if err := json.Unmarshal([]byte(values[i]), &metadata); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			metadata.Timeout = fromSecondsTimeout(metadata.Timeout)
+			j, err := json.Marshal(metadata)
+			if err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(k, string(j), nil); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+func (t *timerDB) StartTimer(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	// fmt.Printf("set timer %s to %s\n", receiptHandle, string(j))
-	err = t.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(receiptHandle, string(j), nil)
+	if err := checkTimeout(timeout); err != nil {
 		return err
-	})
-	if err != nil {
-		fmt.Printf("Failed to update database in start timer: %v\n", err)
-	} else {
-		t.total++
 	}
+	metadata.Timeout = toMillis(time.Now().Add(timeout))
 
-	return err
+	// fmt.Printf("set timer %s to %v\n", receiptHandle, metadata)
+	created := false
+	err := t.update(func(tx *buntdb.Tx) error {
+		var err error
+		created, err = t.startTx(tx, receiptHandle, metadata)
+		return err
+	})
+	return t.started(receiptHandle, created, err)
 }
 
-func (t *timerDB) StopTimer(receiptHandle string) error {
-	err := t.db.Update(func(tx *buntdb.Tx) error {
+func (t *timerDB) StopTimer(ctx context.Context, receiptHandle string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := t.update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(receiptHandle)
 		return err
 	})
+	return t.stopped(receiptHandle, err)
+}
+
+// StartTimers adds the whole batch in one transaction, a failed item doesn't
+// roll back the others
+func (t *timerDB) StartTimers(ctx context.Context, timers []timerRequest) []error {
+	if err := ctx.Err(); err != nil {
+		return batchErrors(len(timers), err)
+	}
+	now := time.Now()
+	errs := make([]error, len(timers))
+	created := make([]bool, len(timers))
+	err := t.update(func(tx *buntdb.Tx) error {
+		for i, r := range timers {
+			if errs[i] = checkTimeout(r.Timeout); errs[i] != nil {
+				continue
+			}
+			r.Metadata.Timeout = toMillis(now.Add(r.Timeout))
+			created[i], errs[i] = t.startTx(tx, r.ReceiptHandle, r.Metadata)
+		}
+		return nil
+	})
 	if err != nil {
-		if !errors.Is(err, buntdb.ErrNotFound) {
-			fmt.Printf("Failed to update database in stop timer: %v\n", err)
+		return batchErrors(len(timers), t.dbError("", err))
+	}
+	for i, r := range timers {
+		if errs[i] != ErrTimeoutOutOfRange {
+			errs[i] = t.started(r.ReceiptHandle, created[i], errs[i])
+		}
+	}
+	return errs
+}
+
+func (t *timerDB) StopTimers(ctx context.Context, receiptHandles []string) []error {
+	if err := ctx.Err(); err != nil {
+		return batchErrors(len(receiptHandles), err)
+	}
+	errs := make([]error, len(receiptHandles))
+	err := t.update(func(tx *buntdb.Tx) error {
+		for i, h := range receiptHandles {
+			_, errs[i] = tx.Delete(h)
+		}
+		return nil
+	})
+	if err != nil {
+		return batchErrors(len(receiptHandles), t.dbError("", err))
+	}
+	for i, h := range receiptHandles {
+		errs[i] = t.stopped(h, errs[i])
+	}
+	return errs
+}
+
+// startTx adds or, depending on the duplicate policy, replaces the timer in
+// tx. It tells if the timer is a new one.
+func (t *timerDB) startTx(tx *buntdb.Tx, receiptHandle string, metadata msgMeta) (bool, error) {
+	created := false
+	if v, err := tx.Get(receiptHandle); err == nil {
+		var old msgMeta
+		if err = json.Unmarshal([]byte(v), &old); err != nil {
+			return false, err
+		}
+		if replace, err := t.dup.replaces(old.Timeout, metadata.Timeout); !replace {
+			return false, err
 		}
+	} else if err != buntdb.ErrNotFound {
+		return false, err
 	} else {
-		t.delC++
+		created = true
+	}
+	j, err := json.Marshal(metadata)
+	if err != nil {
+		fmt.Printf("Failed to encoding to JSON\n")
+		return false, err
+	}
+	_, _, err = tx.Set(receiptHandle, string(j), nil)
+	return created, err
+}
+
+// started and stopped do the bookkeeping once a start or stop is committed
+func (t *timerDB) started(receiptHandle string, created bool, err error) error {
+	if err == nil {
+		if created {
+			t.expired.forget(receiptHandle)
+			t.counters.countCreated(1)
+		}
+	} else if err = t.dbError(receiptHandle, err); err != ErrAlreadyExists && err != ErrClosed {
+		fmt.Printf("Failed to update database in start timer: %v\n", err)
+	}
+
+	return err
+}
+
+func (t *timerDB) stopped(receiptHandle string, err error) error {
+	switch err = t.dbError(receiptHandle, err); err {
+	case nil:
+		t.counters.countStopped(1)
+	case ErrAlreadyExpired:
+		t.counters.countStopAfterExpiry(1)
+	case ErrNotFound, ErrClosed:
+	default:
+		fmt.Printf("Failed to update database in stop timer: %v\n", err)
+	}
+
+	return err
+}
+
+// StartTimerAsync queues the timer for the next StartTimers round. The future
+// resolves once the round commits, that's on disk only with DBSyncAlways,
+// with the default DBSyncEverySecond up to a second of acked timers can be
+// lost in a crash.
+func (t *timerDB) StartTimerAsync(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) ackFuture {
+	return t.async.start(ctx, timerRequest{receiptHandle, timeout, metadata})
+}
+
+func (t *timerDB) StopTimerAsync(ctx context.Context, receiptHandle string) ackFuture {
+	return t.async.stop(ctx, receiptHandle)
+}
+
+func (t *timerDB) ExtendTimer(ctx context.Context, receiptHandle string, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	deadline := toMillis(time.Now().Add(timeout))
+	// read and write back in the same transaction, so the timer can't expire
+	// or be stopped in between
+	err := t.update(func(tx *buntdb.Tx) error {
+		v, err := tx.Get(receiptHandle)
+		if err != nil {
+			return err
+		}
+		var metadata msgMeta
+		if err = json.Unmarshal([]byte(v), &metadata); err != nil {
+			return err
+		}
+		metadata.Timeout = deadline
+		j, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(receiptHandle, string(j), nil)
+		return err
+	})
+	if err = t.dbError(receiptHandle, err); err != nil && err != ErrClosed &&
+		err != ErrNotFound && err != ErrAlreadyExpired {
+		fmt.Printf("Failed to update database in extend timer: %v\n", err)
 	}
 
 	return err
 }
 
-func (t *timerDB) TickProcess() {
-	var n time.Duration = 0
-	// run every seconds
+// dbError maps buntdb errors to the ones shared by all implementations
+func (t *timerDB) dbError(receiptHandle string, err error) error {
+	if errors.Is(err, buntdb.ErrNotFound) {
+		return t.expired.missing(receiptHandle)
+	} else if errors.Is(err, buntdb.ErrDatabaseClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+func (t *timerDB) GetTimer(ctx context.Context, receiptHandle string) (timerInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return timerInfo{}, err
+	}
+	var metadata msgMeta
+	err := t.view(func(tx *buntdb.Tx) error {
+		v, err := tx.Get(receiptHandle)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(v), &metadata)
+	})
+	if err != nil {
+		return timerInfo{}, t.dbError(receiptHandle, err)
+	}
+	return newTimerInfo(metadata), nil
+}
+
+func (t *timerDB) TickProcess(ctx context.Context) {
+	if err := t.catchUpOverdue(); errors.Is(err, buntdb.ErrDatabaseClosed) {
+		return
+	} else if err != nil {
+		fmt.Printf("catch up failed: %v\n", err)
+	}
+	// run every tick
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
 	for {
 		st := time.Now()
-		now := time.Now().Unix() + 1
-		delTo := fmt.Sprintf(`{"Timeout":%d}`, now)
-		var delkeys []string
-		t.db.Update(func(tx *buntdb.Tx) error {
-			tx.AscendLessThan("timer", delTo, func(key, value string) bool {
-				var data msgMeta
-				if err := json.Unmarshal([]byte(value), &data); err != nil {
-					fmt.Printf("json decoding failed: %v\n", err)
-				} else {
-					// process message resend/handle dlq, etc.
-				}
+		if !t.expire(toMillis(st) + 1) {
+			return
+		}
+		t.counters.observeTick(time.Since(st))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-				delkeys = append(delkeys, key)
-				// fmt.Printf("expire timer: %s - %v\n", key, value)
-				return true
-			})
+// overdue returns the timers due before deadline ms, at most limit of them
+func (t *timerDB) overdue(tx *buntdb.Tx, deadline int64, limit int) ([]string, []msgMeta) {
+	var keys []string
+	var metas []msgMeta
+	delTo := fmt.Sprintf(`{"Timeout":%d}`, deadline)
+	tx.AscendLessThan(t.index, delTo, func(key, value string) bool {
+		var data msgMeta
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			fmt.Printf("json decoding failed: %v\n", err)
+		}
+		keys = append(keys, key)
+		metas = append(metas, data)
+		return limit <= 0 || len(keys) < limit
+	})
+	return keys, metas
+}
+
+// catchUpOverdue applies the catch up policy to the timers which were due
+// before InitTimer, the fire policy leaves them to the ticks
+func (t *timerDB) catchUpOverdue() error {
+	if t.catchUp.Policy == CatchUpFire {
+		return nil
+	}
+	now := time.Now()
+	var keys []string
+	var metas []msgMeta
+	err := t.update(func(tx *buntdb.Tx) error {
+		keys, metas = t.overdue(tx, toMillis(t.initAt), 0)
+		var deadlines []int64
+		if t.catchUp.Policy == CatchUpSpread {
+			deadlines = t.catchUp.deadlines(len(keys), now)
+		}
+		for i, k := range keys {
+			if t.catchUp.Policy == CatchUpDrop {
+				if _, err := tx.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			metas[i].Timeout = deadlines[i]
+			j, _ := json.Marshal(metas[i])
+			if _, _, err := tx.Set(k, string(j), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || t.catchUp.Policy != CatchUpDrop {
+		return err
+	}
+	t.counters.countDropped(len(keys))
+	for i, k := range keys {
+		t.expired.add(k)
+		t.catchUp.dropped(k, metas[i])
+	}
+	return nil
+}
 
+// expire fires the timers due before now ms in transactions of at most
+// dbExpiryBatch timers, it returns false once the db is closed
+func (t *timerDB) expire(now int64) bool {
+	for {
+		var delkeys []string
+		var expired []msgMeta
+		err := t.update(func(tx *buntdb.Tx) error {
+			delkeys, expired = t.overdue(tx, now, dbExpiryBatch)
 			var err error
 			for _, k := range delkeys {
 				if _, err = tx.Delete(k); err != nil {
 					fmt.Printf("Failed to delete key: %v, %v\n", k, err)
 					break
-				} else {
-					t.expC++
 				}
 			}
 			return err
 		})
-		delta := time.Since(st)
-		n += 1
-		t.avg = (delta-t.avg)/n + t.avg
-
-		time.Sleep(1 * time.Second)
+		// only hand over the timers once the deletion is committed
+		if errors.Is(err, buntdb.ErrDatabaseClosed) {
+			return false
+		} else if err != nil {
+			return true
+		}
+		t.counters.countExpired(len(delkeys))
+		for i, k := range delkeys {
+			t.expired.add(k)
+			t.handler.TimerExpired(k, expired[i])
+		}
+		if len(delkeys) < dbExpiryBatch {
+			return true
+		}
 	}
 }
 
+func (t *timerDB) Stats() timerStats {
+	var n int
+	t.view(func(tx *buntdb.Tx) error {
+		var err error
+		n, err = tx.Len()
+		return err
+	})
+	return t.counters.stats(int64(n))
+}
+
 func (t *timerDB) PrintTimer() {
-	fmt.Printf("Current time: %v\n", time.Now().Unix())
-	t.db.View(func(tx *buntdb.Tx) error {
+	fmt.Printf("Current time: %v\n", toMillis(time.Now()))
+	t.view(func(tx *buntdb.Tx) error {
 		tx.AscendKeys("*", func(k, v string) bool {
 			fmt.Printf("timer: %v - %v\n", k, v)
 			return true
 		})
 		return nil
 	})
-	fmt.Printf("Total created: %v, expired: %v, canceled: %v\n", t.total, t.expC, t.delC)
-	fmt.Printf("Average tick process time: %v\n", t.avg)
+	printStats(t.Stats())
 }
 
 func (t *timerDB) CloseTimer() {
-	t.db.Close()
+	t.async.close()
+	if t.db != nil {
+		t.db.Close()
+	}
 }
@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -21,117 +25,423 @@ type persistEvent struct {
 	Start  *startEvent `json:",omitempty"`
 	Stop   timerID     `json:",omitempty"`
 	Expire timerID     `json:",omitempty"`
+}
+
+// timer is the timer ev is about
+func (ev persistEvent) timer() timerID {
+	if ev.Start != nil {
+		return ev.Start.ID
+	}
+	if ev.Stop != "" {
+		return ev.Stop
+	}
+	return ev.Expire
+}
+
+// persistBatch is handed to the kafka persistence goroutine, the events of
+// one batch always go out in the same WriteMessages call
+type persistBatch struct {
+	Events []persistEvent
+	Ack    func(error)
+}
 
-	Committed chan<- struct{} `json:"-"`
+// wheelConfig lays out the timerwheel. A slot of level 0 holds one tick of
+// Resolution, a slot of level l spans Slots^l ticks. Timers beyond the last
+// level wait in an overflow bucket, so there's no limit on the timeout.
+type wheelConfig struct {
+	// Resolution is the wheel tick, it defaults to timerConfig.Tick and
+	// can't be below 10ms
+	Resolution time.Duration
+	// Slots per level, 60 by default
+	Slots int
+	// Levels is the number of levels below the overflow bucket, 3 by default
+	Levels int
 }
 
-// Note: changing MaxHours to anything other than 12 or 24 will require some code changes
-// specifically around indexing with `t.cur.Hour()`
-const MaxHours = 12
+const minWheelResolution = 10 * time.Millisecond
+
+func (c wheelConfig) resolution(tick time.Duration) time.Duration {
+	res := c.Resolution
+	if res <= 0 {
+		res = tick
+	}
+	if res < minWheelResolution {
+		return minWheelResolution
+	}
+	return res.Truncate(time.Millisecond)
+}
+
+func (c wheelConfig) slots() int64 {
+	if c.Slots < 2 {
+		return 60
+	}
+	return int64(c.Slots)
+}
+
+// spans returns the number of ticks a slot covers for each level, levels
+// whose slots wouldn't fit an int64 are left out
+func (c wheelConfig) spans() []int64 {
+	slots, levels := c.slots(), c.Levels
+	if levels <= 0 {
+		levels = 3
+	}
+	spans := []int64{1}
+	for len(spans) < levels && spans[len(spans)-1] <= math.MaxInt64/slots/slots {
+		spans = append(spans, spans[len(spans)-1]*slots)
+	}
+	return spans
+}
+
+// kafkaConfig is where a kafkaSink persists the events
+type kafkaConfig struct {
+	// Addr of a broker, "kafka:9092" by default
+	Addr string
+	// Topic is "timerwheel" by default
+	Topic string
+	// Partitions of a new topic, 1 by default. Events are spread by timer
+	// and written to the partitions in parallel.
+	Partitions int
+	// Checkpoint is the offset the replay of each partition starts from
+	// when there's no snapshot, events before it are skipped. Partitions
+	// without one are replayed from the start.
+	Checkpoint map[int]int64
+	// Durable holds back the ack of an Append until the events are written,
+	// StartTimer and friends return the write error. Without it they return
+	// once the events are queued and write errors are only logged.
+	Durable bool
+	// RequiredAcks for the writes, all in-sync replicas by default in
+	// durable mode and none otherwise
+	RequiredAcks kafka.RequiredAcks
+	// Backoff is the wait after the first failed bootstrap or replay, it
+	// doubles up to MaxBackoff. 100ms and 10s by default.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Deadline is how long bootstrap and replay are retried, one minute by
+	// default
+	Deadline time.Duration
+}
+
+// retry calls fn until it succeeds, waiting Backoff after the first failure
+// and doubling it up to MaxBackoff. It gives up with the last error after
+// Deadline or when ctx is done.
+func (c kafkaConfig) retry(ctx context.Context, what string, fn func() error) error {
+	backoff, maxBackoff, deadline := c.Backoff, c.MaxBackoff, c.Deadline
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	if deadline <= 0 {
+		deadline = time.Minute
+	}
+	giveUp := time.After(deadline)
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("kafka %s failed, retrying in %v: %v\n", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-giveUp:
+			return fmt.Errorf("kafka %s: gave up after %v: %w", what, deadline, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c kafkaConfig) partitions() int {
+	if c.Partitions <= 0 {
+		return 1
+	}
+	return c.Partitions
+}
+
+func (c kafkaConfig) requiredAcks() kafka.RequiredAcks {
+	if c.RequiredAcks == kafka.RequireNone && c.Durable {
+		return kafka.RequireAll
+	}
+	return c.RequiredAcks
+}
+
+func (c kafkaConfig) addr() net.Addr {
+	if c.Addr == "" {
+		return kafka.TCP("kafka:9092")
+	}
+	return kafka.TCP(c.Addr)
+}
+
+func (c kafkaConfig) topic() string {
+	if c.Topic == "" {
+		return "timerwheel"
+	}
+	return c.Topic
+}
 
 type timerID string
+
+// a slot entry is only live while gen matches the timer's current generation,
+// entries left behind by ExtendTimer or a restarted handle are skipped
+type wheelEntry struct {
+	id  timerID
+	gen uint64
+}
+type wheelTimer struct {
+	meta msgMeta
+	gen  uint64
+}
+
 type timerwheel struct {
-	Persist chan<- persistEvent
-	ctx     context.Context
-	cancel  func()
+	sink   PersistenceSink
+	ctx    context.Context
+	cancel func()
 
-	expC, startC, stopC uint64
+	counters timerCounters
+	expired  recentExpiry
 
-	processTime []time.Duration
+	handler ExpiryHandler
+	dup     dupPolicy
 
-	lock sync.RWMutex
-	th   [MaxHours][]timerID
-	tm   [60][]timerID
-	ts   [60][]timerID
-	t    map[timerID]msgMeta
-	cur  time.Time
+	lock     sync.RWMutex
+	res      time.Duration
+	spans    []int64          // ticks covered by a slot of each level
+	wheel    [][][]wheelEntry // wheel[level][slot]
+	overflow []wheelEntry     // timers beyond the last level
+	t        map[timerID]wheelTimer
+	gen      uint64
+	stopping map[timerID]uint64 // generation of the stops waiting for their ack
+	cur      int64              // last processed tick, Unix milliseconds / res
+	closed   bool
+	tick     time.Duration
+
+	snapshots     SnapshotStore
+	snapshotEvery time.Duration
+
+	catchUp catchUpConfig
+	initAt  time.Time // timers due before it are caught up on
 }
 
-func KafkaPersist(ctx context.Context, kafkaAddr net.Addr, kafkaTopic string) chan<- persistEvent {
-	conn, err := kafka.Dial("tcp", kafkaAddr.String())
+// kafkaBootstrap creates the topic through the controller, a topic which
+// exists already is fine. It returns the number of partitions the topic
+// has, which is what counts for an existing topic.
+func kafkaBootstrap(ctx context.Context, kafkaAddr net.Addr, kafkaTopic string, partitions int) (int, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", kafkaAddr.String())
 	if err != nil {
-		panic(fmt.Errorf("kafka dial: %w", err))
+		return 0, fmt.Errorf("kafka dial: %w", err)
 	}
 	ctlr, err := conn.Controller()
+	conn.Close()
 	if err != nil {
-		panic(fmt.Errorf("kafka controller: %w", err))
+		return 0, fmt.Errorf("kafka controller: %w", err)
 	}
-	conn.Close()
-	conn, err = kafka.Dial("tcp", fmt.Sprintf("%s:%d", ctlr.Host, ctlr.Port))
+	conn, err = kafka.DialContext(ctx, "tcp", net.JoinHostPort(ctlr.Host, strconv.Itoa(ctlr.Port)))
 	if err != nil {
-		panic(fmt.Errorf("kafka dial controller: %w", err))
+		return 0, fmt.Errorf("kafka dial controller: %w", err)
 	}
 	defer conn.Close()
 	err = conn.CreateTopics(kafka.TopicConfig{
 		Topic:             kafkaTopic,
-		NumPartitions:     1,
+		NumPartitions:     partitions,
 		ReplicationFactor: -1,
+		// only the last message of each timer is kept, an existing topic
+		// keeps whatever policy it was created with
+		ConfigEntries: []kafka.ConfigEntry{
+			{ConfigName: "cleanup.policy", ConfigValue: "compact"},
+		},
 	})
+	if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return 0, fmt.Errorf("kafka create topic: %w", err)
+	}
+	parts, err := conn.ReadPartitions(kafkaTopic)
 	if err != nil {
-		panic(fmt.Errorf("kafka create topic: %w", err))
+		return 0, fmt.Errorf("kafka read partitions: %w", err)
 	}
-	for {
-		parts, err := conn.ReadPartitions(kafkaTopic)
+	if len(parts) == 0 {
+		return 0, fmt.Errorf("kafka topic %s has no partitions yet", kafkaTopic)
+	}
+	if len(parts) != partitions {
+		fmt.Printf("kafka topic %s has %d partitions, not %d\n", kafkaTopic, len(parts), partitions)
+	}
+	return len(parts), nil
+}
+
+// kafkaWrite is one WriteMessages call, acks are for the batches which
+// wait for it in durable mode
+type kafkaWrite struct {
+	msgs []kafka.Message
+	acks []func(error)
+}
+
+// kafkaMessages turns all events of a batch into messages, or none of them
+func kafkaMessages(events []persistEvent) ([]kafka.Message, error) {
+	msgs := make([]kafka.Message, 0, len(events))
+	for _, ev := range events {
+		msg, err := kafkaMessage(ev)
 		if err != nil {
-			panic(fmt.Errorf("read partitions: %w", err))
+			return nil, err
 		}
-		if len(parts) > 0 {
-			break
-		}
-		time.Sleep(1 * time.Second)
+		msgs = append(msgs, msg)
 	}
+	return msgs, nil
+}
 
-	fmt.Printf("persisting to kafka (%s %s)...\n", kafkaAddr, kafkaTopic)
+// KafkaPersist bootstraps the topic of cfg and starts the goroutines writing
+// the batches to it. A batch is acked when it's queued, or in durable mode
+// once it's written with the required acks. It returns an error when the
+// topic can't be set up until the bootstrap deadline.
+func KafkaPersist(ctx context.Context, cfg kafkaConfig) (chan<- persistBatch, int, error) {
+	kafkaAddr, kafkaTopic := cfg.addr(), cfg.topic()
+	var partitions int
+	err := cfg.retry(ctx, "bootstrap", func() error {
+		var err error
+		partitions, err = kafkaBootstrap(ctx, kafkaAddr, kafkaTopic, cfg.partitions())
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fmt.Printf("persisting to kafka (%s %s, %d partitions)...\n", kafkaAddr, kafkaTopic, partitions)
 
-	ret := make(chan persistEvent)
-	kmsgs := make(chan []kafka.Message)
+	writers := make([]chan<- persistBatch, partitions)
+	for p := range writers {
+		writers[p] = kafkaPartitionWriter(ctx, cfg, p)
+	}
+	if partitions == 1 {
+		return writers[0], 1, nil
+	}
+	// split each batch by partition, it's acked once all parts are
+	ret := make(chan persistBatch)
 	go func() {
-		msgs := make([]kafka.Message, 0, 10)
-		safe := false
-		pending := make([]chan<- struct{}, 0)
 		for {
+			var b persistBatch
 			select {
 			case <-ctx.Done():
 				return
-			case kmsgs <- msgs:
-				msgs = msgs[:0]
-				for _, p := range pending {
-					if p != nil {
-						close(p)
-					}
+			case b = <-ret:
+			}
+			parts := make(map[int][]persistEvent)
+			for _, ev := range b.Events {
+				p := kafkaPartition(ev.timer(), partitions)
+				parts[p] = append(parts[p], ev)
+			}
+			acks := splitAck(b.Ack, len(parts))
+			for p, events := range parts {
+				ack := acks[len(acks)-1]
+				acks = acks[:len(acks)-1]
+				select {
+				case <-ctx.Done():
+					ack(ErrClosed)
+				case writers[p] <- persistBatch{events, ack}:
+				}
+			}
+		}
+	}()
+	return ret, partitions, nil
+}
+
+// kafkaPartition hashes a timer onto one of the partitions, so all events
+// of a timer stay in order
+func kafkaPartition(id timerID, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// splitAck returns n acks calling ack with the first error once all of them
+// were called
+func splitAck(ack func(error), n int) []func(error) {
+	var lock sync.Mutex
+	var first error
+	left := n
+	acks := make([]func(error), n)
+	for i := range acks {
+		acks[i] = func(err error) {
+			lock.Lock()
+			if first == nil {
+				first = err
+			}
+			left--
+			done := left == 0
+			lock.Unlock()
+			if done {
+				ack(first)
+			}
+		}
+	}
+	if n == 0 {
+		ack(nil)
+	}
+	return acks
+}
+
+// kafkaPartitionWriter starts the goroutines writing batches to partition p,
+// each partition has its own writer so they write in parallel
+func kafkaPartitionWriter(ctx context.Context, cfg kafkaConfig, p int) chan<- persistBatch {
+	durable := cfg.Durable
+	ret := make(chan persistBatch)
+	kwrites := make(chan kafkaWrite)
+	go func() {
+		var w kafkaWrite
+		for {
+			// only offer a write to the writer when there's something to write
+			out := kwrites
+			if len(w.msgs) == 0 {
+				out = nil
+			}
+			select {
+			case <-ctx.Done():
+				for _, ack := range w.acks {
+					ack(ErrClosed)
 				}
-				pending = pending[:0]
-			case ev := <-ret:
-				val, err := json.Marshal(ev)
+				return
+			case out <- w:
+				// the writer owns the handed over write now
+				w = kafkaWrite{}
+			case b := <-ret:
+				msgs, err := kafkaMessages(b.Events)
 				if err != nil {
-					panic(err)
+					b.Ack(err)
+					continue
 				}
-				if safe {
-					pending = append(pending, ev.Committed)
+				w.msgs = append(w.msgs, msgs...)
+				if durable {
+					w.acks = append(w.acks, b.Ack)
 				} else {
-					close(ev.Committed)
+					b.Ack(nil)
 				}
-				msgs = append(msgs, kafka.Message{Value: val})
 			}
 		}
 	}()
 	go func() {
 		writer := kafka.Writer{
-			Addr:  kafkaAddr,
-			Topic: kafkaTopic,
+			Addr:         cfg.addr(),
+			Topic:        cfg.topic(),
+			Balancer:     kafka.BalancerFunc(func(kafka.Message, ...int) int { return p }),
+			RequiredAcks: cfg.requiredAcks(),
+			// a write is all the messages queued up while the previous one
+			// was running, don't wait for more
+			BatchSize:    1 << 16,
+			BatchTimeout: time.Millisecond,
 		}
+		defer writer.Close()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case msgs := <-kmsgs:
-				if len(msgs) == 0 {
-					time.Sleep(500 * time.Millisecond)
-				}
-
-				err := writer.WriteMessages(ctx, msgs...)
+			case w := <-kwrites:
+				err := writer.WriteMessages(ctx, w.msgs...)
 				if err != nil {
-					panic(err)
+					// without durable mode nobody is told
+					fmt.Printf("kafka write of %d events to partition %d: %v\n", len(w.msgs), p, err)
+				}
+				for _, ack := range w.acks {
+					ack(err)
 				}
 			}
 		}
@@ -139,203 +449,870 @@ func KafkaPersist(ctx context.Context, kafkaAddr net.Addr, kafkaTopic string) ch
 	return ret
 }
 
-func (t *timerwheel) InitTimer() timert {
-	t = &timerwheel{
-		cur:         time.Now(),
-		t:           make(map[timerID]msgMeta),
-		processTime: make([]time.Duration, 0),
+// the header telling a stop tombstone from an expire one
+const kafkaEventHeader = "event"
+
+// kafkaMessage keys ev by its timer so compaction keeps the last message of
+// each timer only. Stop and expire are tombstones, after the broker's
+// delete.retention.ms the timer is gone from the topic altogether.
+func kafkaMessage(ev persistEvent) (kafka.Message, error) {
+	switch {
+	case ev.Stop != "":
+		return kafka.Message{
+			Key:     []byte(ev.Stop),
+			Headers: []kafka.Header{{Key: kafkaEventHeader, Value: []byte("stop")}},
+		}, nil
+	case ev.Expire != "":
+		return kafka.Message{
+			Key:     []byte(ev.Expire),
+			Headers: []kafka.Header{{Key: kafkaEventHeader, Value: []byte("expire")}},
+		}, nil
 	}
-	t.ctx, t.cancel = context.WithCancel(context.Background())
-	for i := 0; i < 60; i++ {
-		t.ts[i] = make([]timerID, 0)
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{Key: []byte(ev.Start.ID), Value: val}, nil
+}
+
+// kafkaEvent turns a message back into the event, unkeyed messages are
+// from before the topic was compacted
+func kafkaEvent(msg kafka.Message) (persistEvent, error) {
+	var ev persistEvent
+	if len(msg.Value) > 0 {
+		err := json.Unmarshal(msg.Value, &ev)
+		return ev, err
+	}
+	tid := timerID(msg.Key)
+	if tid == "" {
+		return ev, fmt.Errorf("tombstone without key")
 	}
-	for i := 0; i < 60; i++ {
-		t.tm[i] = make([]timerID, 0)
+	for _, h := range msg.Headers {
+		if h.Key == kafkaEventHeader && string(h.Value) == "expire" {
+			ev.Expire = tid
+			return ev, nil
+		}
 	}
-	for i := 0; i < MaxHours; i++ {
-		t.th[i] = make([]timerID, 0)
+	ev.Stop = tid
+	return ev, nil
+}
+
+// kafkaReplay hands every event of a partition from offset up to the end of
+// the partition at the time of the call to fn
+func kafkaReplay(ctx context.Context, kafkaAddr net.Addr, kafkaTopic string, partition int, offset int64, fn func(persistEvent)) error {
+	conn, err := kafka.DialLeader(ctx, "tcp", kafkaAddr.String(), kafkaTopic, partition)
+	if err != nil {
+		return fmt.Errorf("kafka dial leader: %w", err)
+	}
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("kafka read offsets: %w", err)
+	}
+	// the start of the topic may be gone already through retention
+	if offset < first {
+		offset = first
+	}
+	if offset >= last {
+		return nil
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{kafkaAddr.String()},
+		Topic:     kafkaTopic,
+		Partition: partition,
+		MaxBytes:  10e6,
+	})
+	defer r.Close()
+	if err := r.SetOffset(offset); err != nil {
+		return err
 	}
-	t.Persist = KafkaPersist(t.ctx, kafka.TCP("kafka:9092"), "perf-"+time.Now().Format("20060102150405"))
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("kafka read: %w", err)
+		}
+		ev, err := kafkaEvent(msg)
+		if err != nil {
+			return fmt.Errorf("kafka decode partition %d offset %d: %w", partition, msg.Offset, err)
+		}
+		fn(ev)
+		if msg.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+// sinkState is the readiness of a sink, a service can report it while the
+// sink is still connecting
+type sinkState int
+
+const (
+	SinkConnecting sinkState = iota
+	SinkReady
+	SinkFailed
+)
+
+func (s sinkState) String() string {
+	switch s {
+	case SinkReady:
+		return "ready"
+	case SinkFailed:
+		return "failed"
+	}
+	return "connecting"
+}
+
+var errSinkConnecting = errors.New("sink is connecting")
+
+// kafkaSink is the PersistenceSink writing to a kafka topic
+type kafkaSink struct {
+	cfg    kafkaConfig
+	ctx    context.Context
+	cancel func()
+
+	// ready is closed once bootstrap is done, the rest is set then
+	ready      chan struct{}
+	batches    chan<- persistBatch
+	partitions int
+	err        error
+}
+
+// newKafkaSink bootstraps the topic in the background, see State. Nothing
+// is written until the first Append.
+func newKafkaSink(cfg kafkaConfig) *kafkaSink {
+	s := &kafkaSink{cfg: cfg, ready: make(chan struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go func() {
+		s.batches, s.partitions, s.err = KafkaPersist(s.ctx, cfg)
+		close(s.ready)
+	}()
+	return s
+}
 
+// State tells if the topic is ready, the error is why bootstrap failed
+func (s *kafkaSink) State() (sinkState, error) {
+	select {
+	case <-s.ready:
+		if s.err != nil {
+			return SinkFailed, s.err
+		}
+		return SinkReady, nil
+	default:
+		return SinkConnecting, nil
+	}
+}
+
+// wait blocks until bootstrap is done
+func (s *kafkaSink) wait(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Append fails right away while bootstrap is running, InitTimer doesn't
+// return before the replay which waits for it
+func (s *kafkaSink) Append(events ...persistEvent) ackFuture {
+	if state, err := s.State(); state != SinkReady {
+		if err == nil {
+			err = errSinkConnecting
+		}
+		return doneAck(err)
+	}
+	ack, done := newAck()
+	select {
+	case s.batches <- persistBatch{events, done}:
+	case <-s.ctx.Done():
+		done(ErrClosed)
+	}
+	return ack
+}
+
+// Replay reads the partitions in parallel, fn is called from several
+// goroutines. It starts over when it fails, replaying the events again is
+// harmless.
+func (s *kafkaSink) Replay(ctx context.Context, from map[int]int64, fn func(persistEvent)) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	if from == nil {
+		from = s.cfg.Checkpoint
+	}
+	fmt.Printf("replaying %s (%d partitions)...\n", s.cfg.topic(), s.partitions)
+	return s.cfg.retry(ctx, "replay", func() error {
+		errs := make(chan error, s.partitions)
+		for p := 0; p < s.partitions; p++ {
+			go func(p int) {
+				errs <- kafkaReplay(ctx, s.cfg.addr(), s.cfg.topic(), p, from[p], fn)
+			}(p)
+		}
+		var first error
+		for p := 0; p < s.partitions; p++ {
+			if err := <-errs; err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// Offsets reads the last offset of each partition from its leader
+func (s *kafkaSink) Offsets(ctx context.Context) (map[int]int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	offsets := make(map[int]int64, s.partitions)
+	for p := 0; p < s.partitions; p++ {
+		conn, err := kafka.DialLeader(ctx, "tcp", s.cfg.addr().String(), s.cfg.topic(), p)
+		if err != nil {
+			return nil, fmt.Errorf("kafka dial leader: %w", err)
+		}
+		offsets[p], err = conn.ReadLastOffset()
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("kafka read offset: %w", err)
+		}
+	}
+	return offsets, nil
+}
+
+// Close stops the persistence goroutines, appends still waiting for the
+// writer fail with ErrClosed
+func (s *kafkaSink) Close() error {
+	s.cancel()
+	return nil
+}
+
+// InitTimer replays the persisted events before the timer is used, a
+// timerConfig without Persistence starts empty every time. When the replay
+// fails the timer is closed, it would miss the timers of the previous run.
+func (t *timerwheel) InitTimer(cfg timerConfig) timert {
+	t = newTimerwheel(cfg)
+	var from map[int]int64
+	if t.snapshots != nil {
+		snap, err := t.snapshots.Load()
+		if err != nil {
+			fmt.Printf("loading snapshot failed, closing the timer: %v\n", err)
+			t.CloseTimer()
+			return t
+		}
+		if snap != nil {
+			t.restore(snap)
+			from = snap.Offsets
+			fmt.Printf("restored %d timers from snapshot of %v\n", len(snap.Timers), snap.Taken)
+		}
+	}
+	if err := t.sink.Replay(t.ctx, from, t.replay); err != nil {
+		fmt.Printf("replay failed, closing the timer: %v\n", err)
+		t.CloseTimer()
+		return t
+	}
+	if n := len(t.t); n > 0 {
+		fmt.Printf("replayed %d running timers\n", n)
+	}
+	return t
+}
+
+// newTimerwheel sets up the wheel, it doesn't replay the sink
+func newTimerwheel(cfg timerConfig) *timerwheel {
+	t := &timerwheel{
+		sink:     cfg.Persistence,
+		t:        make(map[timerID]wheelTimer),
+		stopping: make(map[timerID]uint64),
+		dup:      cfg.Duplicate,
+		tick:     cfg.tick(),
+		res:      cfg.Wheel.resolution(cfg.tick()),
+		spans:    cfg.Wheel.spans(),
+
+		snapshots:     cfg.Snapshots,
+		snapshotEvery: cfg.SnapshotEvery,
+
+		catchUp: cfg.CatchUp,
+		initAt:  time.Now(),
+	}
+	t.handler = cfg.expiryHandler(&t.counters)
+	if t.snapshotEvery <= 0 {
+		t.snapshotEvery = 5 * time.Minute
+	}
+	t.cur = toMillis(time.Now()) / int64(t.res/time.Millisecond)
+	if t.sink == nil {
+		t.sink = nopSink{}
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.wheel = make([][][]wheelEntry, len(t.spans))
+	for l := range t.wheel {
+		t.wheel[l] = make([][]wheelEntry, cfg.Wheel.slots())
+	}
 	return t
 }
 
-func (t *timerwheel) StartTimer(receiptHandle string, timeout0 int, metadata msgMeta) error {
-	deadline := time.Now().Add(time.Duration(timeout0) * time.Second)
+// settleFunc is called with the ack of a change to the wheel and the lock
+// held, it rolls the change back when the ack is an error
+type settleFunc func(err error)
+
+// start places the timer, the lock must be held. It returns the event to
+// persist, nil when the timer was kept as is, and what settles it.
+func (t *timerwheel) start(receiptHandle string, deadline time.Time, metadata msgMeta) (*persistEvent, settleFunc, error) {
 	tid := timerID(receiptHandle)
-	metadata.Timeout = deadline.Unix()
+	metadata.Timeout = toMillis(deadline)
+	w, found := t.t[tid]
+	if found {
+		// the old slot entry becomes stale when it is replaced
+		replace, err := t.dup.replaces(w.meta.Timeout, metadata.Timeout)
+		if !replace {
+			return nil, nil, err
+		}
+	}
+	t.gen++
+	t.place(wheelEntry{tid, t.gen}, metadata.Timeout)
+	t.t[tid] = wheelTimer{metadata, t.gen}
+	delete(t.stopping, tid)
+	if !found {
+		t.expired.forget(receiptHandle)
+		t.counters.countCreated(1)
+	}
+	return &persistEvent{
+		Start: &startEvent{
+			ID:       tid,
+			Timeout:  deadline,
+			Metadata: metadata,
+		},
+	}, t.undoStart(tid, w, found), nil
+}
+
+// undoStart puts back the timer prev, or nothing when it wasn't found,
+// unless the timer changed again since
+func (t *timerwheel) undoStart(tid timerID, prev wheelTimer, found bool) settleFunc {
+	gen := t.gen
+	return func(err error) {
+		if w, ok := t.t[tid]; err == nil || !ok || w.gen != gen {
+			return
+		}
+		if !found {
+			delete(t.t, tid)
+			t.counters.countCreated(-1)
+			return
+		}
+		t.gen++
+		prev.gen = t.gen
+		t.place(wheelEntry{tid, t.gen}, prev.meta.Timeout)
+		t.t[tid] = prev
+	}
+}
+
+// stop removes the timer, the lock must be held. It returns the event to
+// persist and what settles it, the timer is put back when the stop isn't
+// persisted and it wasn't started again meanwhile.
+func (t *timerwheel) stop(receiptHandle string) (*persistEvent, settleFunc, error) {
+	tid := timerID(receiptHandle)
+	if w, found := t.t[tid]; found {
+		delete(t.t, tid)
+		t.counters.countStopped(1)
+		t.gen++
+		gen := t.gen
+		t.stopping[tid] = gen
+		return &persistEvent{Stop: tid}, func(err error) {
+			if t.stopping[tid] != gen {
+				return
+			}
+			delete(t.stopping, tid)
+			if err != nil {
+				t.gen++
+				w.gen = t.gen
+				t.place(wheelEntry{tid, t.gen}, w.meta.Timeout)
+				t.t[tid] = w
+				t.counters.countStopped(-1)
+			}
+		}, nil
+	}
+	err := t.expired.missing(receiptHandle)
+	if err == ErrAlreadyExpired {
+		t.counters.countStopAfterExpiry(1)
+	}
+	return nil, nil, err
+}
+
+// settled returns a future with the result of ack, once the settle funcs
+// have seen it
+func (t *timerwheel) settled(ack ackFuture, settles ...settleFunc) ackFuture {
+	settle := func(err error) {
+		t.lock.Lock()
+		for _, fn := range settles {
+			fn(err)
+		}
+		t.lock.Unlock()
+	}
+	select {
+	case err := <-ack:
+		settle(err)
+		return doneAck(err)
+	default:
+	}
+	out, done := newAck()
+	go func() {
+		err := <-ack
+		settle(err)
+		done(err)
+	}()
+	return out
+}
+
+func (t *timerwheel) StartTimer(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) error {
+	return t.wait(ctx, t.StartTimerAsync(ctx, receiptHandle, timeout, metadata))
+}
+
+func (t *timerwheel) StopTimer(ctx context.Context, receiptHandle string) error {
+	return t.wait(ctx, t.StopTimerAsync(ctx, receiptHandle))
+}
+
+// StartTimerAsync places the timer right away, the future is the ack of the
+// sink for the start event. When it's an error the start is rolled back.
+func (t *timerwheel) StartTimerAsync(ctx context.Context, receiptHandle string, timeout time.Duration, metadata msgMeta) ackFuture {
+	if err := checkTimeout(timeout); err != nil {
+		return doneAck(err)
+	}
 	t.lock.Lock()
-	timeout := deadline.Sub(t.cur)
-	if timeout < 0 {
-		t.expC++
-		return nil
-	} else if timeout > MaxHours*time.Hour {
-		return errors.New("timeout must be <12hrs")
+	if t.closed {
+		t.lock.Unlock()
+		return doneAck(ErrClosed)
+	}
+	ev, settle, err := t.start(receiptHandle, time.Now().Add(timeout), metadata)
+	if ev == nil {
+		t.lock.Unlock()
+		return doneAck(err)
+	}
+	ack := t.sink.Append(*ev)
+	t.lock.Unlock()
+	return t.settled(ack, settle)
+}
+
+func (t *timerwheel) StopTimerAsync(ctx context.Context, receiptHandle string) ackFuture {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return doneAck(ErrClosed)
+	}
+	ev, settle, err := t.stop(receiptHandle)
+	if ev == nil {
+		t.lock.Unlock()
+		return doneAck(err)
 	}
+	ack := t.sink.Append(*ev)
+	t.lock.Unlock()
+	return t.settled(ack, settle)
+}
 
-	if timeout > 1*time.Hour {
-		ih := timeout / time.Hour
-		t.th[ih] = append(t.th[ih], tid)
-	} else if timeout > 1*time.Minute {
-		im := timeout / time.Minute
-		t.tm[im] = append(t.tm[im], tid)
-	} else {
-		is := timeout / time.Second
-		t.ts[is] = append(t.ts[is], tid)
+// StartTimers places all timers under one lock and persists them as a single
+// batch, a persist error is returned for every timer of the batch and they
+// are all rolled back
+func (t *timerwheel) StartTimers(ctx context.Context, timers []timerRequest) []error {
+	errs := make([]error, len(timers))
+	events := make([]persistEvent, 0, len(timers))
+	settles := make([]settleFunc, 0, len(timers))
+	persisted := make([]int, 0, len(timers))
+	now := time.Now()
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return batchErrors(len(timers), ErrClosed)
 	}
-	t.t[tid] = metadata
-	t.startC++
+	for i, r := range timers {
+		if errs[i] = checkTimeout(r.Timeout); errs[i] != nil {
+			continue
+		}
+		var ev *persistEvent
+		var settle settleFunc
+		if ev, settle, errs[i] = t.start(r.ReceiptHandle, now.Add(r.Timeout), r.Metadata); ev != nil {
+			events = append(events, *ev)
+			settles = append(settles, settle)
+			persisted = append(persisted, i)
+		}
+	}
+	ack := t.append(events)
 	t.lock.Unlock()
-	persist := t.Persist
-	if persist != nil {
-		ctx := t.ctx
-		committed := make(chan struct{})
-		persist <- persistEvent{
-			Start: &startEvent{
-				ID:       tid,
-				Timeout:  deadline,
-				Metadata: metadata,
-			},
-			Committed: committed,
+	if err := t.persist(ctx, ack, settles...); err != nil {
+		for _, i := range persisted {
+			errs[i] = err
 		}
+	}
+	return errs
+}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-committed:
+func (t *timerwheel) StopTimers(ctx context.Context, receiptHandles []string) []error {
+	errs := make([]error, len(receiptHandles))
+	events := make([]persistEvent, 0, len(receiptHandles))
+	settles := make([]settleFunc, 0, len(receiptHandles))
+	persisted := make([]int, 0, len(receiptHandles))
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return batchErrors(len(receiptHandles), ErrClosed)
+	}
+	for i, h := range receiptHandles {
+		var ev *persistEvent
+		var settle settleFunc
+		if ev, settle, errs[i] = t.stop(h); ev != nil {
+			events = append(events, *ev)
+			settles = append(settles, settle)
+			persisted = append(persisted, i)
 		}
 	}
-	return nil
+	ack := t.append(events)
+	t.lock.Unlock()
+	if err := t.persist(ctx, ack, settles...); err != nil {
+		for _, i := range persisted {
+			errs[i] = err
+		}
+	}
+	return errs
 }
 
-func (t *timerwheel) StopTimer(receiptHandle string) error {
-	found := false
-	t.lock.Lock()
+func (t *timerwheel) ExtendTimer(ctx context.Context, receiptHandle string, timeout time.Duration) error {
+	if err := checkTimeout(timeout); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
 	tid := timerID(receiptHandle)
-	if _, found = t.t[tid]; found {
-		t.stopC++
-		delete(t.t, tid)
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return ErrClosed
+	}
+	w, found := t.t[tid]
+	if !found {
+		t.lock.Unlock()
+		return t.expired.missing(receiptHandle)
 	}
+	// the entry in the old slot becomes stale with the new generation
+	prev := w
+	t.gen++
+	t.place(wheelEntry{tid, t.gen}, toMillis(deadline))
+	w.meta.Timeout = toMillis(deadline)
+	w.gen = t.gen
+	t.t[tid] = w
+	settle := t.undoStart(tid, prev, true)
+	// replaying a start event again moves the timer to the new deadline
+	ack := t.append([]persistEvent{{
+		Start: &startEvent{
+			ID:       tid,
+			Timeout:  deadline,
+			Metadata: w.meta,
+		},
+	}})
 	t.lock.Unlock()
-	if found {
-		// copy stuff we want to use without a lock
-		persist := t.Persist
-		if persist != nil {
-			ctx := t.ctx
-			committed := make(chan struct{})
-			persist <- persistEvent{Stop: tid, Committed: committed}
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-committed:
-			}
+	return t.persist(ctx, ack, settle)
+}
+
+func (t *timerwheel) GetTimer(ctx context.Context, receiptHandle string) (timerInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return timerInfo{}, err
+	}
+	t.lock.RLock()
+	w, found := t.t[timerID(receiptHandle)]
+	closed := t.closed
+	t.lock.RUnlock()
+	if closed {
+		return timerInfo{}, ErrClosed
+	}
+	if !found {
+		return timerInfo{}, t.expired.missing(receiptHandle)
+	}
+	return newTimerInfo(w.meta), nil
+}
+
+// place puts e into the slot for its deadline (in Unix milliseconds). A
+// level is used when the deadline is at most one turn of it ahead, so the
+// slot index taken modulo the slots never points at an unprocessed turn of
+// the same slot. Has to be called with the lock held.
+func (t *timerwheel) place(e wheelEntry, deadline int64) {
+	// round up to the wheel resolution, overdue timers fire on the next tick
+	d := tickSlot(deadline, t.res)
+	if d <= t.cur {
+		d = t.cur + 1
+	}
+	slots := int64(len(t.wheel[0]))
+	for l, span := range t.spans {
+		if d-t.cur <= slots*span {
+			i := (d / span) % slots
+			t.wheel[l][i] = append(t.wheel[l][i], e)
+			return
 		}
 	}
-	return nil
+	t.overflow = append(t.overflow, e)
+}
+
+// replay applies a persisted event to the wheel. A start event is an upsert,
+// ExtendTimer and a replaced duplicate persist a start event again. Timers
+// with a deadline in the past fire on the next tick.
+func (t *timerwheel) replay(ev persistEvent) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case ev.Start != nil:
+		meta := ev.Start.Metadata
+		meta.Timeout = toMillis(ev.Start.Timeout)
+		t.gen++
+		t.place(wheelEntry{ev.Start.ID, t.gen}, meta.Timeout)
+		t.t[ev.Start.ID] = wheelTimer{meta, t.gen}
+	case ev.Stop != "":
+		delete(t.t, ev.Stop)
+	case ev.Expire != "":
+		delete(t.t, ev.Expire)
+		t.expired.add(string(ev.Expire))
+	}
+}
+
+// catchUpOverdue applies the catch up policy to the timers which were due
+// before InitTimer, the fire policy leaves them to the ticks. The changes
+// are persisted like stops and extends.
+func (t *timerwheel) catchUpOverdue(ctx context.Context) error {
+	if t.catchUp.Policy == CatchUpFire {
+		return nil
+	}
+	cutoff := toMillis(t.initAt)
+	t.lock.Lock()
+	var overdue []timerID
+	for tid, w := range t.t {
+		if w.meta.Timeout < cutoff {
+			overdue = append(overdue, tid)
+		}
+	}
+	sort.Slice(overdue, func(i, j int) bool {
+		return t.t[overdue[i]].meta.Timeout < t.t[overdue[j]].meta.Timeout
+	})
+	events := make([]persistEvent, 0, len(overdue))
+	dropped := make([]msgMeta, 0, len(overdue))
+	if t.catchUp.Policy == CatchUpDrop {
+		for _, tid := range overdue {
+			dropped = append(dropped, t.t[tid].meta)
+			delete(t.t, tid)
+			t.expired.add(string(tid))
+			events = append(events, persistEvent{Stop: tid})
+		}
+	} else {
+		for i, d := range t.catchUp.deadlines(len(overdue), time.Now()) {
+			tid := overdue[i]
+			w := t.t[tid]
+			w.meta.Timeout = d
+			t.gen++
+			w.gen = t.gen
+			t.place(wheelEntry{tid, t.gen}, d)
+			t.t[tid] = w
+			events = append(events, persistEvent{
+				Start: &startEvent{ID: tid, Timeout: fromMillis(d), Metadata: w.meta},
+			})
+		}
+	}
+	ack := t.append(events)
+	t.lock.Unlock()
+	t.counters.countDropped(len(dropped))
+	for i, meta := range dropped {
+		t.catchUp.dropped(string(overdue[i]), meta)
+	}
+	return t.persist(ctx, ack)
 }
 
-func (t *timerwheel) TickProcess() {
+// snapshot saves the running timers together with the sink offsets. The
+// offsets are read before the timers are copied: an event is applied before
+// it's appended, so everything before the offsets is in the copy. Events
+// after them may be in the copy too, replaying them again is harmless.
+func (t *timerwheel) snapshot(ctx context.Context) error {
+	offsets, err := t.sink.Offsets(ctx)
+	if err != nil {
+		return err
+	}
+	t.lock.RLock()
+	snap := &wheelSnapshot{
+		Taken:      time.Now(),
+		Offsets:    offsets,
+		Resolution: t.res,
+		Cur:        t.cur,
+		Timers:     make([]startEvent, 0, len(t.t)),
+	}
+	for tid, w := range t.t {
+		snap.Timers = append(snap.Timers, startEvent{tid, fromMillis(w.meta.Timeout), w.meta})
+	}
+	t.lock.RUnlock()
+	return t.snapshots.Save(snap)
+}
+
+func (t *timerwheel) snapshotLoop(ctx context.Context) {
+	ticker := time.NewTicker(t.snapshotEvery)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-t.ctx.Done():
 			return
-		case <-time.After(1 * time.Second):
+		case <-ticker.C:
 		}
-		t.lock.RLock()
-		delta := time.Since(t.cur)
-		if delta < time.Second {
-			t.lock.RUnlock()
-			continue
+		if err := t.snapshot(ctx); err != nil {
+			fmt.Printf("snapshot failed: %v\n", err)
 		}
-		t.lock.RUnlock()
-		t.lock.Lock()
-		for ; delta > time.Second; delta -= time.Second {
-			pstart := time.Now()
+	}
+}
 
-			for _, tid := range t.ts[t.cur.Second()] {
-				if _, found := t.t[tid]; found {
-					t.expC++
-					delete(t.t, tid)
-					persist := t.Persist
-					if persist != nil {
-						ctx := t.ctx
-						committed := make(chan struct{})
-						persist <- persistEvent{Expire: tid, Committed: committed}
-						select {
-						case <-ctx.Done():
-							return
-						case <-committed:
-						}
-					}
-				}
+// restore loads the timers of a snapshot. The wheel position is taken over
+// when it's behind, so TickProcess catches up on the ticks missed while down.
+func (t *timerwheel) restore(snap *wheelSnapshot) {
+	t.lock.Lock()
+	if snap.Resolution == t.res && snap.Cur < t.cur {
+		t.cur = snap.Cur
+	}
+	t.lock.Unlock()
+	for i := range snap.Timers {
+		t.replay(persistEvent{Start: &snap.Timers[i]})
+	}
+}
+
+// append hands events to the sink as one batch, the lock must be held so
+// the sink gets the events in the order they were applied to the wheel.
+// Otherwise a start and a stop of the same timer could swap places on the
+// way and replay would bring back a stopped timer.
+func (t *timerwheel) append(events []persistEvent) ackFuture {
+	if len(events) == 0 {
+		return doneAck(nil)
+	}
+	return t.sink.Append(events...)
+}
+
+// persist waits for the ack of append without the lock, the settle funcs
+// see it even when ctx is done first
+func (t *timerwheel) persist(ctx context.Context, ack ackFuture, settles ...settleFunc) error {
+	return t.wait(ctx, t.settled(ack, settles...))
+}
+
+// wait gives up on ack when either ctx is canceled or the timer is closed
+func (t *timerwheel) wait(ctx context.Context, ack ackFuture) error {
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.ctx.Done():
+		return ErrClosed
+	}
+}
+
+func (t *timerwheel) TickProcess(ctx context.Context) {
+	if err := t.catchUpOverdue(ctx); err != nil {
+		fmt.Printf("catch up failed: %v\n", err)
+	}
+	if t.snapshots != nil {
+		go t.snapshotLoop(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.ctx.Done():
+			return
+		case <-time.After(t.tick):
+		}
+		now := toMillis(time.Now()) / int64(t.res/time.Millisecond)
+		for {
+			t.lock.Lock()
+			if t.cur >= now {
+				t.lock.Unlock()
+				break
 			}
-			t.ts[t.cur.Second()] = t.ts[t.cur.Second()][:0]
-
-			t.cur.Add(1 * time.Second)
-			if t.cur.Second() == 0 {
-				im := t.cur.Minute()
-				for _, tid := range t.tm[im] {
-					if meta, found := t.t[tid]; found {
-						js := t.cur.Sub(time.Unix(meta.Timeout, 0)) / time.Second
-						t.ts[js] = append(t.ts[js], tid)
-					}
+			pstart := time.Now()
+			s := t.cur + 1
+			slots := int64(len(t.wheel[0]))
+			// refill the last level from the overflow bucket once per turn of
+			// that level, whatever is left is still more than a turn away,
+			// then cascade the levels starting now top down before firing
+			// this tick
+			top := len(t.spans) - 1
+			if s%(t.spans[top]*slots) == 0 && len(t.overflow) > 0 {
+				overflow := t.overflow
+				t.overflow = nil
+				t.cascade(&overflow)
+			}
+			for l := top; l > 0; l-- {
+				if span := t.spans[l]; s%span == 0 {
+					t.cascade(&t.wheel[l][(s/span)%slots])
 				}
-				t.tm[im] = t.tm[im][:0]
-
-				if im == 0 {
-					ih := t.cur.Hour() % 12
-					for _, tid := range t.th[ih] {
-						if meta, found := t.t[tid]; found {
-							jm := t.cur.Sub(time.Unix(meta.Timeout, 0)) / time.Minute
-							t.tm[jm] = append(t.tm[jm], tid)
-						}
-					}
-					t.th[ih] = t.th[ih][:0]
+			}
+			expired := make(map[timerID]msgMeta)
+			slot := &t.wheel[0][s%slots]
+			for _, e := range *slot {
+				if w, found := t.t[e.id]; found && w.gen == e.gen {
+					expired[e.id] = w.meta
+					delete(t.t, e.id)
+					t.expired.add(string(e.id))
 				}
 			}
-			pend := time.Now()
-			t.processTime = append(t.processTime, pend.Sub(pstart))
+			*slot = (*slot)[:0]
+			t.cur = s
+			events := make([]persistEvent, 0, len(expired))
+			for tid := range expired {
+				events = append(events, persistEvent{Expire: tid})
+			}
+			ack := t.append(events)
 			t.lock.Unlock()
-			t.lock.Lock()
+			t.counters.observeTick(time.Since(pstart))
+			t.counters.countExpired(len(expired))
+
+			// wait for the sink and call the handler without lock, it may
+			// start new timers. The timers are gone from the wheel either
+			// way, so they fire even when the expiry isn't persisted, a
+			// restart fires them again.
+			err := t.persist(ctx, ack)
+			if err != nil && ctx.Err() == nil && t.ctx.Err() == nil {
+				fmt.Printf("persisting %d expired timers failed: %v\n", len(events), err)
+			}
+			for tid, meta := range expired {
+				t.handler.TimerExpired(string(tid), meta)
+			}
+			if ctx.Err() != nil || t.ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// cascade moves the timers of a slot down the wheel, stale entries are
+// dropped on the way
+func (t *timerwheel) cascade(slot *[]wheelEntry) {
+	entries := *slot
+	*slot = (*slot)[:0:0]
+	for _, e := range entries {
+		if w, found := t.t[e.id]; found && w.gen == e.gen {
+			t.place(e, w.meta.Timeout)
 		}
-		t.lock.Unlock()
 	}
 }
 
+func (t *timerwheel) Stats() timerStats {
+	t.lock.RLock()
+	n := len(t.t)
+	t.lock.RUnlock()
+	return t.counters.stats(int64(n))
+}
+
 func (t *timerwheel) PrintTimer() {
 	t.lock.RLock()
-	fmt.Printf("Current time: %d (tick: %d)\n", time.Now().Unix(), t.cur.Unix())
-	for tid, meta := range t.t {
-		fmt.Printf("timer: %s, deadline: %s\n", tid, time.Unix(meta.Timeout, 0))
-	}
-	fmt.Printf("Total created: %d, expired: %d, canceled: %d\n", t.startC, t.expC, t.stopC)
-	if len(t.processTime) > 0 {
-		avg := float64(0)
-		n := float64(len(t.processTime))
-		min := time.Duration((1 << 63) - 1)
-		max := time.Duration(0)
-		for _, pt := range t.processTime {
-			avg += float64(pt) / n
-			if pt > max {
-				max = pt
-			}
-			if pt < min {
-				min = pt
-			}
-		}
-		fmt.Printf("Average tick process time: %v (n: %d, min: %v, max: %v)\n", avg, len(t.processTime), min, max)
-	} else {
-		fmt.Printf("Average tick process time: <didn't process anything?>")
+	fmt.Printf("Current time: %d (tick: %d)\n", time.Now().Unix(), t.cur)
+	for tid, w := range t.t {
+		fmt.Printf("timer: %s, deadline: %s\n", tid, fromMillis(w.meta.Timeout))
 	}
 	t.lock.RUnlock()
+	printStats(t.Stats())
 }
 
+// CloseTimer stops TickProcess and closes the sink
 func (t *timerwheel) CloseTimer() {
-	cancel, persist := t.cancel, t.Persist
-	if cancel != nil {
-		cancel()
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+	if t.cancel != nil {
+		t.cancel()
 	}
-	if persist != nil {
-		close(persist)
+	if err := t.sink.Close(); err != nil {
+		fmt.Printf("close sink: %v\n", err)
 	}
 }
@@ -5,191 +5,537 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/go-redis/redis/v8"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-// use buntDB for timer
-// with transaction, no lock is needed
-type timerRedis struct {
-	rdb   *redis.Client
-	ctx   context.Context
-	total int           // counter for all timer created
-	delC  int           // counter for all timer canceled
-	expC  int           // counter for expired timers
-	avg   time.Duration // avg time used to process timer each tick (one second)
-	max   time.Duration // max time used to process timer each tick
-	min   time.Duration // min time used to process timer each tick
-	nE    int           // number of cancel of expired timer
-	lock  sync.Mutex    // lock used to protect counters during concurrent process
-}
-
-func (t *timerRedis) InitTimer() timert {
-	t = &timerRedis{
-		rdb:   nil,
-		ctx:   context.Background(),
-		total: 0,
-		delC:  0,
-		expC:  0,
-		avg:   0,
-		max:   0,
-		min:   time.Duration(^uint64(0) >> 1),
-		nE:    0}
-	t.rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-	if err := t.rdb.Ping(context.Background()).Err(); err != nil {
-		fmt.Printf("can't connect to redis: %v\n", err)
-	}
+// how long an expired receiptHandle is remembered, so a late StopTimer gets
+// ErrAlreadyExpired instead of ErrNotFound
+const expiredTTL = 10 * time.Minute
 
-	return t
+// redisConfig is where a Redis timer keeps its timers, the zero value is DB 0
+// of localhost:6379 with the "timer:" prefix
+type redisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	// Prefix of every key the timer uses, deployments sharing a db need
+	// different ones. Glob characters are fine, the scans escape them.
+	Prefix string
 }
 
-func (t *timerRedis) StartTimer(receiptHandle string, timeout int, metadata msgMeta) error {
-	now := time.Now().Unix()
-	setT := now + int64(timeout)
-	metadata.Timeout = setT
+func (rc redisConfig) client() *redis.Client {
+	addr := rc.Addr
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: rc.Password,
+		DB:       rc.DB,
+	})
+}
 
-	// use JSON string for any metadata saved together with each timer
-	j, err := json.Marshal(metadata)
-	if err != nil {
-		fmt.Printf("Failed to encoding to JSON\n")
-		return err
+func (rc redisConfig) keys() redisKeys {
+	if rc.Prefix == "" {
+		return "timer:"
 	}
-	// use Transction Pipeline to provide atomic operation
-	pipe := t.rdb.TxPipeline()
-	pipe.Set(t.ctx, receiptHandle, string(j), 0)
-	pipe.SAdd(t.ctx, strconv.FormatInt(setT, 10), receiptHandle)
-	_, err = pipe.Exec(t.ctx)
-	if err != nil {
-		fmt.Printf("Failed to update database in start timer: %v\n", err)
-	} else {
-		t.total++
+	return redisKeys(rc.Prefix)
+}
+
+// redisKeys is the prefix all keys of a Redis timer start with, the methods
+// name them
+type redisKeys string
+
+// match is a SCAN pattern for the keys starting with prefix and matching
+// pattern after it, the glob characters of prefix are escaped
+func match(prefix, pattern string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
 	}
+	return b.String() + pattern
+}
 
-	return err
+// timer is the key of the metadata of receiptHandle in the per slot layout
+func (k redisKeys) timer(receiptHandle string) string {
+	return string(k) + "h:" + receiptHandle
 }
 
-func (t *timerRedis) StopTimer(receiptHandle string) error {
-	r, err := t.rdb.Del(t.ctx, receiptHandle).Result()
-	if err != nil {
-		fmt.Printf("Failed to update database in stop timer: %v\n", err)
-	} else if r == 0 {
-		// These are timer already expired hence does not exist in Redis DB anymore
-		t.nE++
-	} else {
-		t.delC++
+// slots is the prefix of the slot sets, the rest is the Unix ms of the slot
+func (k redisKeys) slots() string {
+	return string(k) + "s:"
+}
+
+// expired marks a receiptHandle as expired for expiredTTL
+func (k redisKeys) expired(receiptHandle string) string {
+	return string(k) + "expired:" + receiptHandle
+}
+
+// count is the number of running timers in the per slot layout, the
+// scripts keep it up to date
+func (k redisKeys) count() string {
+	return string(k) + "count"
+}
+
+// claimed is the sorted set of the timers a claim script took out whose
+// handler hasn't returned yet, scored by the Unix ms their lease runs out
+func (k redisKeys) claimed() string {
+	return string(k) + "claimed"
+}
+
+// claimedTimers is the hash with the values of the claimed timers
+func (k redisKeys) claimedTimers() string {
+	return string(k) + "claimed:timers"
+}
+
+// progress holds the slot up to which TickProcess is done, in Unix ms. It's
+// the checkpoint a restarted process resumes from, claimScript moves it.
+func (k redisKeys) progress() string {
+	return string(k) + "progress"
+}
+
+// SET NX and SADD have to be in one script, a MULTI can't skip the SADD when
+// the timer exists already. ARGV[2] is the receiptHandle, KEYS[4] the count.
+var startScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX') then
+	redis.call('SADD', KEYS[2], ARGV[2])
+	redis.call('DEL', KEYS[3])
+	redis.call('INCR', KEYS[4])
+	return 1
+end
+return 0
+`)
+
+// most timers claimScript takes out of a slot in one call
+const claimBatch = 1000
+
+// claimScript pops up to ARGV[1] handles from the slot set KEYS[1] and
+// moves the running ones to the claimed set KEYS[5] with a lease until
+// ARGV[7] and their values in KEYS[4], leaving the expired marker with
+// prefix ARGV[3] for ARGV[2] seconds. It returns the number popped and the
+// handle and value of each claimed timer. A handle whose deadline was moved
+// past the slot starting at ARGV[4] is in its new slot too, it's only
+// dropped here. When ARGV[5] is set and the slot is empty now, the progress
+// KEYS[2] is moved up to the slot in the same step, so a crash can't skip a
+// slot which wasn't claimed or claim one twice, the claimed timers fire
+// again once their lease runs out. The timer keys are ARGV[6] and the
+// handle, the count KEYS[3] goes down by the timers claimed.
+// The timer keys and expired markers aren't in KEYS, they are only known
+// once popped, so the script needs a single Redis rather than a cluster.
+var claimScript = redis.NewScript(`
+local hs = redis.call('SPOP', KEYS[1], ARGV[1])
+if ARGV[5] == '1' and #hs < tonumber(ARGV[1]) then
+	local p = redis.call('GET', KEYS[2])
+	if not p or tonumber(p) < tonumber(ARGV[4]) then
+		redis.call('SET', KEYS[2], ARGV[4])
+	end
+end
+local out = {#hs}
+for _, h in ipairs(hs) do
+	local v = redis.call('GET', ARGV[6] .. h)
+	if v and tonumber(cjson.decode(v).Timeout) <= tonumber(ARGV[4]) then
+		redis.call('DEL', ARGV[6] .. h)
+		redis.call('SET', ARGV[3] .. h, '', 'EX', ARGV[2])
+		redis.call('HSET', KEYS[4], h, v)
+		redis.call('ZADD', KEYS[5], ARGV[7], h)
+		table.insert(out, h)
+		table.insert(out, v)
+	end
+end
+if #out > 1 then
+	redis.call('DECRBY', KEYS[3], (#out - 1) / 2)
+end
+return out
+`)
+
+// stopScript deletes timer KEYS[1] and removes it from its slot set, the
+// slot is worked out from the deadline like tickSlot with a tick of ARGV[2]
+// milliseconds. The slot set keys start with ARGV[1], ARGV[3] is the
+// receiptHandle and KEYS[2] the count. The slot set isn't in KEYS, it's only
+// known from the value.
+var stopScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return 0
+end
+local tms = tonumber(ARGV[2])
+local slot = math.ceil(tonumber(cjson.decode(v).Timeout) / tms) * tms
+redis.call('DEL', KEYS[1])
+redis.call('SREM', ARGV[1] .. string.format('%d', slot), ARGV[3])
+redis.call('DECR', KEYS[2])
+return 1
+`)
+
+// legacyMoveScript moves timer ARGV[1] of the layout without prefix, whose
+// key is KEYS[1] and slot set KEYS[2], to the key KEYS[3] with the value
+// ARGV[3] and the slot set KEYS[4], KEYS[5] is the count. The old key has to
+// have the value ARGV[2] still, it's gone for a stopped timer. A timer
+// started under the prefix meanwhile is kept.
+var legacyMoveScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v and v ~= ARGV[2] then
+	return 0
+end
+redis.call('SREM', KEYS[2], ARGV[1])
+if not v then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if redis.call('SET', KEYS[3], ARGV[3], 'NX') then
+	redis.call('SADD', KEYS[4], ARGV[1])
+	redis.call('INCR', KEYS[5])
+end
+return 1
+`)
+
+// use Redis for timer with a set of receiptHandles per tick slot, TickProcess
+// takes the sets of the slots which are due
+type timerRedis struct {
+	*redisBase
+}
+
+func (t *timerRedis) InitTimer(cfg timerConfig) timert {
+	return newTimerRedis(cfg, redisConfig{})
+}
+
+// newTimerRedis connects to the db of rc, the timer only uses the keys
+// under rc.Prefix. The default prefix takes over the timers an earlier
+// version kept without one first, see migrateLegacy.
+func newTimerRedis(cfg timerConfig, rc redisConfig) *timerRedis {
+	base, err := newRedisBase(cfg, rc)
+	t := &timerRedis{base}
+	t.layout = t
+	// the keys of the versions without prefix are taken over by the default
+	// one, when Redis can't be reached that's printed already
+	if err == nil && t.keys == (redisConfig{}).keys() {
+		if n, err := t.migrateLegacy(t.ctx, t.legacyCall); err != nil {
+			fmt.Printf("Failed to migrate the timers without prefix: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("Migrated %d timers without prefix\n", n)
+		}
 	}
+	t.async = newAsyncQueue(t)
+
+	return t
+}
+
+func (t *timerRedis) startCall(receiptHandle, value string, deadline int64) redisCall {
+	return redisCall{startScript,
+		[]string{t.keys.timer(receiptHandle), t.slotKey(tickSlot(deadline, t.tick)), t.keys.expired(receiptHandle), t.keys.count()},
+		[]interface{}{value, receiptHandle}}
+}
+
+func (t *timerRedis) stopCall(receiptHandle string) redisCall {
+	return redisCall{stopScript,
+		[]string{t.keys.timer(receiptHandle), t.keys.count()},
+		[]interface{}{t.keys.slots(), int64(t.tick / time.Millisecond), receiptHandle}}
+}
+
+func (t *timerRedis) legacyCall(slot, receiptHandle, old, value string, deadline int64) redisCall {
+	return redisCall{legacyMoveScript,
+		[]string{receiptHandle, slot, t.keys.timer(receiptHandle), t.slotKey(tickSlot(deadline, t.tick)), t.keys.count()},
+		[]interface{}{receiptHandle, old, value}}
+}
+
+func (t *timerRedis) get(ctx context.Context, receiptHandle string) (string, error) {
+	return t.rdb.Get(ctx, t.keys.timer(receiptHandle)).Result()
+}
 
+// update replaces a running timer with what fn returns for it, unless fn
+// returns false. The timer is WATCHed, so nothing changes it between reading
+// the old deadline and moving it to the new slot in one MULTI.
+func (t *timerRedis) update(ctx context.Context, receiptHandle string, fn func(msgMeta) (msgMeta, bool, error)) error {
+	txf := func(tx *redis.Tx) error {
+		v, err := tx.Get(ctx, t.keys.timer(receiptHandle)).Result()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var old msgMeta
+		if err = json.Unmarshal([]byte(v), &old); err != nil {
+			return err
+		}
+		metadata, replace, err := fn(old)
+		if !replace {
+			return err
+		}
+		j, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, t.keys.timer(receiptHandle), string(j), 0)
+			pipe.SRem(ctx, t.slotKey(tickSlot(old.Timeout, t.tick)), receiptHandle)
+			pipe.SAdd(ctx, t.slotKey(tickSlot(metadata.Timeout, t.tick)), receiptHandle)
+			return nil
+		})
+		return err
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = t.rdb.Watch(ctx, txf, t.keys.timer(receiptHandle)); err != redis.TxFailedErr {
+			break
+		}
+	}
 	return err
 }
 
-func (t *timerRedis) TickProcess() {
-	// set initial value, this can be saved to a config and read each time it restart
-	lastT := time.Now().Unix() - 5
-	// run every seconds
-	var n time.Duration = 0
+func (t *timerRedis) TickProcess(ctx context.Context) {
+	// start right after the overdue slots handled by the catch up, which is
+	// retried until it's done, e.g. while Redis isn't up yet. The ticks can't
+	// go ahead, they would checkpoint past the overdue slots.
+	var lastT int64
+	for {
+		var err error
+		if lastT, err = t.catchUpOverdue(ctx); err == nil {
+			break
+		} else if err == ErrClosed {
+			return
+		}
+		fmt.Printf("catch up failed, retrying: %v\n", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.tick):
+		}
+	}
+	// run every tick
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
 	for {
 		st := time.Now()
-		now := time.Now().Unix()
+		now := toMillis(st) / int64(t.tick/time.Millisecond)
 		// start from last tick since if there's new timer added right after SMembers
 		// call, it will be processed here
-		var p = false // This is used for statistic counter only
+		// the slot of now is done again next round, it's not checkpointed
+		next := now
+		if err := t.reclaim(ctx, t.fire); err == ErrClosed {
+			return
+		}
 		for i := lastT; i <= now; i++ {
-			// Get all timer from set which will expire at this round of process
-			results, err := t.rdb.SMembers(t.ctx, strconv.FormatInt(i, 10)).Result()
-			if err != nil {
-				fmt.Printf("Failed to get member for %d, %v\n", i, err)
+			err := t.expireSlot(ctx, i*int64(t.tick/time.Millisecond), i < now)
+			if err == ErrClosed {
+				return
+			} else if err != nil {
+				// the later slots wait, so the progress doesn't skip this one
+				next = i
+				break
+			}
+		}
+		// Calculate the time used to process in this round
+		t.counters.observeTick(time.Since(st))
+
+		lastT = next
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireSlot fires the timers in the slot set starting at ms, with done the
+// progress is moved up to it once it's empty
+func (t *timerRedis) expireSlot(ctx context.Context, ms int64, done bool) error {
+	return t.claim(ctx, ms, done, t.fire)
+}
+
+// claim takes the due timers out of the slot set starting at ms in batches
+// of claimBatch, each batch in one round trip, and hands them to fn. With
+// done the last batch checkpoints the slot in the progress key.
+func (t *timerRedis) claim(ctx context.Context, ms int64, done bool, fn func(string, msgMeta)) error {
+	key := t.msSlotKey(ms)
+	checkpoint := "0"
+	if done {
+		checkpoint = "1"
+	}
+	for {
+		v, err := claimScript.Run(ctx, t.rdb,
+			[]string{key, t.keys.progress(), t.keys.count(), t.keys.claimedTimers(), t.keys.claimed()},
+			claimBatch, int64(expiredTTL/time.Second), t.keys.expired(""), ms, checkpoint, t.keys.timer(""),
+			toMillis(time.Now().Add(claimLease))).Result()
+		var popped int64
+		if err == nil {
+			popped, err = t.handOver(ctx, v, fn)
+		}
+		if err != nil {
+			if err = redisError(err); err != ErrClosed && ctx.Err() == nil {
+				fmt.Printf("Failed to claim timers of %s, %v\n", key, err)
 			}
-			if len(results) > 0 {
-				p = true
+			return err
+		}
+		if popped < claimBatch {
+			return nil
+		}
+	}
+}
+
+// up to this many slots behind the progress are walked one by one on
+// startup, beyond that the keyspace is scanned for the slots
+const catchUpWalkSlots = 10000
+
+// catchUpOverdue applies the catch up policy to the slots before InitTimer
+// which TickProcess hasn't done yet. It returns the first slot left to the
+// ticks.
+func (t *timerRedis) catchUpOverdue(ctx context.Context) (int64, error) {
+	tms := int64(t.tick / time.Millisecond)
+	cutoff := tickSlot(toMillis(t.initAt), t.tick)
+	slots, err := t.overdueSlots(ctx, cutoff)
+	if err != nil {
+		return cutoff, err
+	}
+	switch t.catchUp.Policy {
+	case CatchUpFire:
+		for _, ms := range slots {
+			if err = t.expireSlot(ctx, ms, true); err != nil {
+				return cutoff, err
 			}
-			for _, h := range results {
-				// Use goroutine for each expired message processing
-				// Sequence process in Redis is really slow
-				go func(h string, i int64, t *timerRedis) {
-					v, err := t.rdb.Get(t.ctx, h).Result()
-					// we don't remove receipHandle from timer list
-					// so the receiptHanle key might not there
-					if v != "" {
-						var msgD msgMeta
-						err = json.Unmarshal([]byte(v), &msgD)
-						// process the msgD, resend msg or put it into DLQ
-					}
-					pipe := t.rdb.TxPipeline()
-					// Del from the message list
-					pipe.Del(t.ctx, h).Err()
-					// Remove from this time slot,
-					// don't need to remove the timer slot, once the set is empty, Redis
-					// will remove the key automatically
-					pipe.SRem(t.ctx, strconv.FormatInt(i, 10), h)
-					_, err = pipe.Exec(t.ctx)
-					if err != nil {
-						fmt.Printf("Failed to update database in expiry timer: %v\n", err)
-					} else {
-						t.lock.Lock()
-						t.expC++
-						t.lock.Unlock()
-					}
-				}(h, i, t)
+		}
+	case CatchUpDrop:
+		for _, ms := range slots {
+			err = t.claim(ctx, ms, true, func(h string, metadata msgMeta) {
+				t.counters.countDropped(1)
+				t.catchUp.dropped(h, metadata)
+			})
+			if err != nil {
+				return cutoff, err
 			}
 		}
-		// Calculate the time used to process in this round
-		if p {
-			delta := time.Since(st)
-			if delta < t.min {
-				t.min = delta
+	case CatchUpSpread:
+		var handles []string
+		for _, ms := range slots {
+			hs, err := t.rdb.SMembers(ctx, t.msSlotKey(ms)).Result()
+			if err != nil {
+				return cutoff, redisError(err)
 			}
-			if delta > t.max {
-				t.max = delta
+			handles = append(handles, hs...)
+		}
+		for i, d := range t.catchUp.deadlines(len(handles), time.Now()) {
+			err := t.update(ctx, handles[i], func(metadata msgMeta) (msgMeta, bool, error) {
+				metadata.Timeout = d
+				return metadata, true, nil
+			})
+			if err != nil && err != ErrNotFound {
+				return cutoff, redisError(err)
 			}
-			n += 1
-			t.avg = (delta-t.avg)/n + t.avg
 		}
+		// what's left are stopped timers
+		for _, ms := range slots {
+			t.rdb.Del(ctx, t.msSlotKey(ms))
+		}
+	}
+	err = t.rdb.Set(ctx, t.keys.progress(), strconv.FormatInt((cutoff-1)*tms, 10), 0).Err()
+	return cutoff, redisError(err)
+}
 
-		lastT = now
-		time.Sleep(1 * time.Second)
+// overdueSlots returns the start in Unix ms of the slots before slot cutoff
+// which are after the persisted progress, oldest first. Without progress, or
+// when it's far behind, the keyspace is scanned for them.
+func (t *timerRedis) overdueSlots(ctx context.Context, cutoff int64) ([]int64, error) {
+	tms := int64(t.tick / time.Millisecond)
+	var slots []int64
+	progress, err := t.rdb.Get(ctx, t.keys.progress()).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, redisError(err)
+	}
+	if err == nil && cutoff-progress/tms <= catchUpWalkSlots {
+		for i := progress/tms + 1; i < cutoff; i++ {
+			slots = append(slots, i*tms)
+		}
+		return slots, nil
+	}
+	err = scanSlotSets(ctx, t.rdb, t.keys, func(ms int64) error {
+		if ms < cutoff*tms {
+			slots = append(slots, ms)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	return slots, nil
 }
 
+// scanSlotSets calls fn with the start in Unix ms of every slot set under
+// keys, in no particular order
+func scanSlotSets(ctx context.Context, rdb *redis.Client, keys redisKeys, fn func(ms int64) error) error {
+	prefix := keys.slots()
+	var cur uint64
+	for {
+		batch, next, err := rdb.Scan(ctx, cur, match(prefix, "[0-9]*"), 1000).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		for _, k := range batch {
+			if ms, err := strconv.ParseInt(k[len(prefix):], 10, 64); err == nil {
+				if err := fn(ms); err != nil {
+					return err
+				}
+			}
+		}
+		if cur = next; cur == 0 {
+			return nil
+		}
+	}
+}
+
+// slotKey is the name of the set holding the timers due in tick slot i
+func (t *timerRedis) slotKey(i int64) string {
+	return t.msSlotKey(i * int64(t.tick/time.Millisecond))
+}
+
+// msSlotKey is the name of the set of the slot starting at ms
+func (t *timerRedis) msSlotKey(ms int64) string {
+	return t.keys.slots() + strconv.FormatInt(ms, 10)
+}
+
+// Stats has the outstanding timers of all processes sharing the prefix, the
+// other counts are of this process
+func (t *timerRedis) Stats() timerStats {
+	n, err := t.rdb.Get(t.ctx, t.keys.count()).Int64()
+	if err != nil || n < 0 {
+		n = 0
+	}
+	return t.counters.stats(n)
+}
+
+// PrintTimer only scans the keys under the prefix, the expired markers are
+// counted but not listed
 func (t *timerRedis) PrintTimer() {
-	fmt.Printf("Current time: %v\n", time.Now().Unix())
+	fmt.Printf("Current time: %v\n", toMillis(time.Now()))
 	var cur uint64
-	var n int
+	var n, expired int
 	for {
 		var keys []string
 		var err error
-		keys, cur, err = t.rdb.Scan(t.ctx, cur, "*", 10).Result()
+		keys, cur, err = t.rdb.Scan(t.ctx, cur, match(string(t.keys), "*"), 10).Result()
 		if err != nil {
 			fmt.Printf("Failed to scan the db: %v\n", err)
 			break
 		}
 		for _, k := range keys {
-			t, err := t.rdb.Type(t.ctx, k).Result()
-			if err != nil {
-				fmt.Printf("Failed to get type for: %s, %v\n", k, err)
-			} else {
-				if t == "string" {
-					fmt.Printf("Timer: %v still in db\n", k)
-				} else if t == "set" {
-					fmt.Printf("Timer tick: %v still in db\n", k)
-				} else {
-					fmt.Printf("Key: %v, type: %v\n", k, t)
-				}
+			switch {
+			case strings.HasPrefix(k, t.keys.timer("")):
+				fmt.Printf("Timer: %v still in db\n", k[len(t.keys.timer("")):])
+				n++
+			case strings.HasPrefix(k, t.keys.slots()):
+				fmt.Printf("Timer tick: %v still in db\n", k[len(t.keys.slots()):])
+			case strings.HasPrefix(k, t.keys.expired("")):
+				expired++
 			}
 		}
-		n += len(keys)
 		if cur == 0 {
 			break
 		}
 	}
-	fmt.Printf("Still total %d entries in db\n", n)
-	fmt.Printf("Total created: %v, expired: %v, canceled: %v, not-exit: %v\n", t.total, t.expC, t.delC, t.nE)
-	fmt.Printf("Average tick process time, avg: %v, min: %v, max: %v\n", t.avg, t.min, t.max)
-}
-
-func (t *timerRedis) CloseTimer() {
+	fmt.Printf("Still total %d timers and %d expired markers in db\n", n, expired)
+	printStats(t.Stats())
 }
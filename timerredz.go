@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// zTimers is the hash with the metadata of every timer in the sorted set
+// layout
+func (k redisKeys) zTimers() string {
+	return string(k) + "timers"
+}
+
+// zDeadlines is the sorted set of the receiptHandles scored by deadline in
+// Unix milliseconds
+func (k redisKeys) zDeadlines() string {
+	return string(k) + "deadlines"
+}
+
+// zStartScript adds timer ARGV[1] with value ARGV[2] and deadline ARGV[3]
+// unless it's running already, KEYS[3] is its expired marker
+var zStartScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+	redis.call('DEL', KEYS[3])
+	return 1
+end
+return 0
+`)
+
+// zReplaceScript replaces timer ARGV[1] with value ARGV[3] and deadline
+// ARGV[4] if its value is still ARGV[2]. It returns -1 when the timer is
+// gone and 0 when it was changed meanwhile.
+var zReplaceScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if not v then
+	return -1
+end
+if v ~= ARGV[2] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[1])
+return 1
+`)
+
+var zStopScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 1 then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// zClaimScript takes up to ARGV[2] timers due on or before ARGV[1] out of
+// both keys into the claimed set KEYS[4] with a lease until ARGV[5] and
+// their values in KEYS[3], leaving the expired marker with prefix ARGV[4]
+// for ARGV[3] seconds. It returns the number taken and the handle and value
+// of each.
+// ZPOPMIN can't stop at a score, so it's ZRANGEBYSCORE and ZREM. The expired
+// markers aren't in KEYS, like in claimScript.
+var zClaimScript = redis.NewScript(`
+local hs = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local out = {#hs}
+for _, h in ipairs(hs) do
+	redis.call('ZREM', KEYS[2], h)
+	local v = redis.call('HGET', KEYS[1], h)
+	if v then
+		redis.call('HDEL', KEYS[1], h)
+		redis.call('SET', ARGV[4] .. h, '', 'EX', ARGV[3])
+		redis.call('HSET', KEYS[3], h, v)
+		redis.call('ZADD', KEYS[4], ARGV[5], h)
+		table.insert(out, h)
+		table.insert(out, v)
+	end
+end
+return out
+`)
+
+// zMigrateScript moves timer ARGV[1] of the per slot set layout, whose key
+// is KEYS[4] and slot set KEYS[3], into the hash KEYS[1] and the sorted set
+// KEYS[2]. A timer started in the new layout meanwhile is kept.
+var zMigrateScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[4])
+if v then
+	if redis.call('HSETNX', KEYS[1], ARGV[1], v) == 1 then
+		redis.call('ZADD', KEYS[2], cjson.decode(v).Timeout, ARGV[1])
+	end
+	redis.call('DEL', KEYS[4])
+end
+redis.call('SREM', KEYS[3], ARGV[1])
+return v and 1 or 0
+`)
+
+// zLegacyMoveScript moves timer ARGV[1] of the layout without prefix, whose
+// key is KEYS[1] and slot set KEYS[2], into the hash KEYS[3] with the value
+// ARGV[3] and the sorted set KEYS[4] with the deadline ARGV[4]. The old key
+// has to have the value ARGV[2] still, like in legacyMoveScript.
+var zLegacyMoveScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v and v ~= ARGV[2] then
+	return 0
+end
+redis.call('SREM', KEYS[2], ARGV[1])
+if not v then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if redis.call('HSETNX', KEYS[3], ARGV[1], ARGV[3]) == 1 then
+	redis.call('ZADD', KEYS[4], ARGV[4], ARGV[1])
+end
+return 1
+`)
+
+// use Redis for timer with a single sorted set as the deadline index instead
+// of a set per tick. Expiry takes whatever is due in one range query, so
+// deadlines are as fine as the tick and the timers can be counted and listed
+// in deadline order.
+type timerRedisZ struct {
+	*redisBase
+}
+
+func (t *timerRedisZ) InitTimer(cfg timerConfig) timert {
+	return newTimerRedisZ(cfg, redisConfig{})
+}
+
+// newTimerRedisZ connects to the db of rc and moves the timers left in the
+// per slot set layout of timerRedis under the same prefix over first, the
+// timerRedis processes using it have to be stopped. The default prefix takes
+// over the timers an earlier version kept without one too.
+func newTimerRedisZ(cfg timerConfig, rc redisConfig) *timerRedisZ {
+	base, err := newRedisBase(cfg, rc)
+	t := &timerRedisZ{base}
+	t.layout = t
+	// when Redis can't be reached that's printed already
+	if err == nil && t.keys == (redisConfig{}).keys() {
+		if n, err := t.migrateLegacy(t.ctx, t.legacyCall); err != nil {
+			fmt.Printf("Failed to migrate the timers without prefix: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("Migrated %d timers without prefix\n", n)
+		}
+	}
+	if err == nil {
+		if n, err := t.migrate(t.ctx); err != nil {
+			fmt.Printf("Failed to migrate the slot sets: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("Migrated %d timers from the slot sets\n", n)
+		}
+	}
+	t.async = newAsyncQueue(t)
+
+	return t
+}
+
+// migrate moves the timers of the per slot set layout into the sorted set
+// and returns how many there were, the slot sets, the progress and the count
+// are removed. It's safe to run again after a failure.
+func (t *timerRedisZ) migrate(ctx context.Context) (int, error) {
+	var slots []string
+	err := scanSlotSets(ctx, t.rdb, t.keys, func(ms int64) error {
+		slots = append(slots, t.keys.slots()+strconv.FormatInt(ms, 10))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, key := range slots {
+		if typ, err := t.rdb.Type(ctx, key).Result(); err != nil {
+			return n, redisError(err)
+		} else if typ != "set" {
+			continue
+		}
+		handles, err := t.rdb.SMembers(ctx, key).Result()
+		if err != nil {
+			return n, redisError(err)
+		}
+		for _, h := range handles {
+			r, err := zMigrateScript.Run(ctx, t.rdb,
+				[]string{t.keys.zTimers(), t.keys.zDeadlines(), key, t.keys.timer(h)}, h).Int()
+			if err != nil {
+				return n, redisError(err)
+			}
+			n += r
+		}
+	}
+	return n, redisError(t.rdb.Del(ctx, t.keys.progress(), t.keys.count()).Err())
+}
+
+func (t *timerRedisZ) startCall(receiptHandle, value string, deadline int64) redisCall {
+	return redisCall{zStartScript,
+		[]string{t.keys.zTimers(), t.keys.zDeadlines(), t.keys.expired(receiptHandle)},
+		[]interface{}{receiptHandle, value, deadline}}
+}
+
+func (t *timerRedisZ) stopCall(receiptHandle string) redisCall {
+	return redisCall{zStopScript,
+		[]string{t.keys.zTimers(), t.keys.zDeadlines()},
+		[]interface{}{receiptHandle}}
+}
+
+func (t *timerRedisZ) legacyCall(slot, receiptHandle, old, value string, deadline int64) redisCall {
+	return redisCall{zLegacyMoveScript,
+		[]string{receiptHandle, slot, t.keys.zTimers(), t.keys.zDeadlines()},
+		[]interface{}{receiptHandle, old, value, deadline}}
+}
+
+func (t *timerRedisZ) get(ctx context.Context, receiptHandle string) (string, error) {
+	return t.rdb.HGet(ctx, t.keys.zTimers(), receiptHandle).Result()
+}
+
+// update replaces a running timer with what fn returns for it, unless fn
+// returns false. zReplaceScript only replaces the value fn saw, so when the
+// timer changed meanwhile fn is called again with the new one.
+func (t *timerRedisZ) update(ctx context.Context, receiptHandle string, fn func(msgMeta) (msgMeta, bool, error)) error {
+	for i := 0; i < 10; i++ {
+		v, err := t.rdb.HGet(ctx, t.keys.zTimers(), receiptHandle).Result()
+		if err == redis.Nil {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		var old msgMeta
+		if err = json.Unmarshal([]byte(v), &old); err != nil {
+			return err
+		}
+		metadata, replace, err := fn(old)
+		if !replace {
+			return err
+		}
+		j, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		r, err := zReplaceScript.Run(ctx, t.rdb, []string{t.keys.zTimers(), t.keys.zDeadlines()},
+			receiptHandle, v, string(j), metadata.Timeout).Int()
+		if err != nil {
+			return err
+		}
+		switch r {
+		case -1:
+			return ErrNotFound
+		case 1:
+			return nil
+		}
+	}
+	return redis.TxFailedErr
+}
+
+// NextDue returns the receiptHandles of the n timers due next, in deadline
+// order
+func (t *timerRedisZ) NextDue(ctx context.Context, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	handles, err := t.rdb.ZRange(ctx, t.keys.zDeadlines(), 0, int64(n-1)).Result()
+	return handles, redisError(err)
+}
+
+// CountDue counts the running timers due from from up to and including to
+func (t *timerRedisZ) CountDue(ctx context.Context, from, to time.Time) (int64, error) {
+	n, err := t.rdb.ZCount(ctx, t.keys.zDeadlines(),
+		strconv.FormatInt(toMillis(from), 10), strconv.FormatInt(toMillis(to), 10)).Result()
+	return n, redisError(err)
+}
+
+func (t *timerRedisZ) TickProcess(ctx context.Context) {
+	if err := t.catchUpOverdue(ctx); err == ErrClosed {
+		return
+	} else if err != nil {
+		fmt.Printf("catch up failed: %v\n", err)
+	}
+	// run every tick
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
+	for {
+		st := time.Now()
+		err := t.reclaim(ctx, t.fire)
+		if err != ErrClosed {
+			err = t.claim(ctx, toMillis(st), t.fire)
+		}
+		if err == ErrClosed {
+			return
+		}
+		// Calculate the time used to process in this round
+		t.counters.observeTick(time.Since(st))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim takes the timers due on or before ms out in batches of claimBatch,
+// each batch in one round trip, and hands them to fn
+func (t *timerRedisZ) claim(ctx context.Context, ms int64, fn func(string, msgMeta)) error {
+	for {
+		v, err := zClaimScript.Run(ctx, t.rdb,
+			[]string{t.keys.zTimers(), t.keys.zDeadlines(), t.keys.claimedTimers(), t.keys.claimed()},
+			ms, claimBatch, int64(expiredTTL/time.Second), t.keys.expired(""),
+			toMillis(time.Now().Add(claimLease))).Result()
+		var taken int64
+		if err == nil {
+			taken, err = t.handOver(ctx, v, fn)
+		}
+		if err != nil {
+			if err = redisError(err); err != ErrClosed && ctx.Err() == nil {
+				fmt.Printf("Failed to claim timers due by %d, %v\n", ms, err)
+			}
+			return err
+		}
+		if taken < claimBatch {
+			return nil
+		}
+	}
+}
+
+// catchUpOverdue applies the catch up policy to the timers due before
+// InitTimer, the sorted set has them without any bookkeeping of progress
+func (t *timerRedisZ) catchUpOverdue(ctx context.Context) error {
+	cutoff := toMillis(t.initAt)
+	switch t.catchUp.Policy {
+	case CatchUpFire:
+		return t.claim(ctx, cutoff, t.fire)
+	case CatchUpDrop:
+		return t.claim(ctx, cutoff, func(h string, metadata msgMeta) {
+			t.counters.countDropped(1)
+			t.catchUp.dropped(h, metadata)
+		})
+	case CatchUpSpread:
+		handles, err := t.rdb.ZRangeByScore(ctx, t.keys.zDeadlines(), &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(cutoff, 10),
+		}).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		for i, d := range t.catchUp.deadlines(len(handles), time.Now()) {
+			err := t.update(ctx, handles[i], func(metadata msgMeta) (msgMeta, bool, error) {
+				metadata.Timeout = d
+				return metadata, true, nil
+			})
+			if err != nil && err != ErrNotFound {
+				return redisError(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *timerRedisZ) Stats() timerStats {
+	n, err := t.rdb.ZCard(t.ctx, t.keys.zDeadlines()).Result()
+	if err != nil {
+		n = 0
+	}
+	return t.counters.stats(n)
+}
+
+func (t *timerRedisZ) PrintTimer() {
+	fmt.Printf("Current time: %v\n", toMillis(time.Now()))
+	zs, err := t.rdb.ZRangeWithScores(t.ctx, t.keys.zDeadlines(), 0, -1).Result()
+	if err != nil {
+		fmt.Printf("Failed to read the deadlines: %v\n", err)
+	}
+	for _, z := range zs {
+		fmt.Printf("Timer: %v due %d still in db\n", z.Member, int64(z.Score))
+	}
+	fmt.Printf("Still total %d entries in db\n", len(zs))
+	printStats(t.Stats())
+}